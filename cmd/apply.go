@@ -14,33 +14,184 @@ limitations under the License.
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
 	. "github.com/mudler/entities/pkg/entities"
 	"github.com/spf13/cobra"
 )
 
+func printApplySummary(results []ApplyResult) {
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Action]++
+		switch r.Action {
+		case ActionCreated:
+			fmt.Printf("%s %s created\n", r.Kind, r.Name)
+		case ActionUpdated:
+			fmt.Printf("%s %s updated: %s\n", r.Kind, r.Name, strings.Join(r.Changes, ", "))
+		case ActionDeleted:
+			fmt.Printf("%s %s deleted\n", r.Kind, r.Name)
+		}
+	}
+
+	fmt.Printf("Applied %d entities: %d created, %d updated, %d unchanged.\n",
+		len(results)-counts[ActionDeleted], counts[ActionCreated], counts[ActionUpdated],
+		counts[ActionUnchanged])
+	if counts[ActionDeleted] > 0 {
+		fmt.Printf("Pruned %d entities.\n", counts[ActionDeleted])
+	}
+}
+
 var applyCmd = &cobra.Command{
-	Use:   "apply",
+	Use:   "apply [<entity.yaml>...]",
 	Short: "applies an entity",
-	Args:  cobra.MinimumNArgs(1),
-	Long:  `Applies a entity yaml file to your system`,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		p := &Parser{}
+	Long: `Applies a entity yaml file to your system.
+
+With multiple files or with specs directories all the entities are applied
+together, writing each file once. Groups are applied before the users and
+the users before their shadow entries.
+
+	$> entities apply <entity.yaml>
+	$> entities apply -s <specs-dir> [-s <specs-dir>] [<entity.yaml>...]
 
+With --dry-run the changes are printed as a unified diff of each file,
+with the passwords redacted, and nothing is written.
+
+Files are written only if an entity is created or updated. For automation,
+--output json prints the action taken for each entity and
+--detailed-exitcode exits with 2 when something changed.
+
+With --prune the entities of the system missing in the specs are removed.
+Only the ones selected by --include, --exclude, --min-id and --max-id are
+considered, by default the users and groups with id in the human range.
+Only the entities owned by entities, recorded in the state file when created
+or applied, are removed. Without a state, as with --file, nothing is pruned
+unless --force is used to remove all the entities selected:
+
+	$> entities apply -s <specs-dir> --prune --dry-run
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		specsdirs, _ := cmd.Flags().GetStringArray("specs-dir")
+		if len(args) == 0 && len(specsdirs) == 0 {
+			return errors.New("At least one entity file or specs directory is needed.")
+		}
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "text", "json":
+		default:
+			return errors.New("Invalid output value. Admits values are: text|json.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
 		safe, _ := cmd.Flags().GetBool("safe")
+		specsdirs, _ := cmd.Flags().GetStringArray("specs-dir")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		prune, _ := cmd.Flags().GetBool("prune")
 
-		entity, err := p.ReadEntity(args[0])
+		store := NewEntitiesStore()
+		for _, d := range specsdirs {
+			err := store.Load(d)
+			if err != nil {
+				return errors.New(
+					"Error on load specs from directory " + d + ": " + err.Error())
+			}
+		}
+		for _, f := range args {
+			err := store.LoadFile(f)
+			if err != nil {
+				return errors.New("Error on load spec " + f + ": " + err.Error())
+			}
+		}
+
+		files := filesFromFlags(cmd)
+		if entityFile != "" {
+			if len(args) != 1 || len(specsdirs) > 0 {
+				return errors.New("--file can be used only with a single entity file.")
+			}
+			entities := store.Entities()
+			if len(entities) == 0 {
+				return errors.New("No entities in " + args[0])
+			}
+			for _, e := range entities[1:] {
+				if e.GetKind() != entities[0].GetKind() {
+					return errors.New("--file can be used only with entities of the same kind.")
+				}
+			}
+			files = entityFilesFromFlags(cmd, entities[0])
+		}
+
+		force, _ := cmd.Flags().GetBool("force")
+		opts := ApplyOptions{Safe: safe, Prune: prune, Force: force}
+		if prune {
+			filter, err := filterFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			opts.PruneFilter = filter
+		}
+
+		if dryRun {
+			changes, err := store.PlanWithOptions(files, opts)
+			if err != nil {
+				return err
+			}
+			return printPlan(cmd, changes)
+		}
+
+		results, err := store.ApplyWithOptions(files, opts)
 		if err != nil {
 			return err
 		}
 
-		return entity.Apply(entityFile, safe)
+		printApplyResults(cmd, results)
+
+		return nil
 	},
 }
 
+// printApplyResults prints the results in the selected output format and
+// exits with exitChanged if requested and an entity changed.
+func printApplyResults(cmd *cobra.Command, results []ApplyResult) {
+	output, _ := cmd.Flags().GetString("output")
+	detailed, _ := cmd.Flags().GetBool("detailed-exitcode")
+
+	if output == "json" {
+		data, _ := json.Marshal(results)
+		fmt.Println(string(data))
+	} else {
+		printApplySummary(results)
+	}
+
+	if detailed {
+		for _, r := range results {
+			if r.Changed() {
+				os.Exit(exitChanged)
+			}
+		}
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(applyCmd)
 
 	var flags = applyCmd.Flags()
 	flags.Bool("safe", false,
 		"Avoid to override existing entity if it has difference or if the id is used in a different way.")
+	flags.StringArrayP("specs-dir", "s", []string{},
+		"Define the directory where read entities specs.")
+	flags.Bool("dry-run", false,
+		"Print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	flags.StringP("output", "o", "text", "Output format: text|json")
+	flags.Bool("detailed-exitcode", false,
+		"Exit with 2 when an entity was created, updated or deleted.")
+	flags.Bool("prune", false,
+		"Remove the entities of the system missing in the specs.")
+	flags.Bool("force", false, "Prune the entities also without a state file.")
+	addFilesFlags(flags)
+	addFilterFlags(flags)
 }
@@ -0,0 +1,164 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	tablewriter "github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// parseShadowDate converts a date in the YYYY-MM-DD format to the days since
+// 1970-01-01 used by the shadow file. Numbers are returned as is.
+func parseShadowDate(value string) (string, error) {
+	if value == "" || value == ShadowUnset {
+		return value, nil
+	}
+
+	if _, err := strconv.Atoi(value); err == nil {
+		return value, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", errors.New("Invalid date " + value + ". Use YYYY-MM-DD or days since 1970-01-01.")
+	}
+
+	return fmt.Sprintf("%d", t.Unix()/24/60/60), nil
+}
+
+func parseShadowDays(value string) (string, error) {
+	if value == "" || value == ShadowUnset {
+		return value, nil
+	}
+
+	if i, err := strconv.Atoi(value); err != nil || i < 0 {
+		return "", errors.New("Invalid number of days " + value)
+	}
+
+	return value, nil
+}
+
+func showAging(s Shadow) error {
+	lastChanged, err := ShadowDate(s.LastChanged)
+	if err != nil {
+		return err
+	}
+	expire, err := ShadowDate(s.Expire)
+	if err != nil {
+		return err
+	}
+
+	never := func(v string) string {
+		if v == "" {
+			return "never"
+		}
+		return v
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorders(tablewriter.Border{
+		Left:   true,
+		Top:    true,
+		Right:  true,
+		Bottom: true,
+	})
+	table.SetHeader([]string{"Field", "Value"})
+	table.AppendBulk([][]string{
+		{"Last Password Change", never(lastChanged)},
+		{"Minimum Changed", s.MinimumChanged},
+		{"Maximum Changed", s.MaximumChanged},
+		{"Warning Expiration", s.Warn},
+		{"Inactive", s.Inactive},
+		{"Expire", never(expire)},
+	})
+	table.Render()
+
+	return nil
+}
+
+var chageCmd = &cobra.Command{
+	Use:   "chage <user>",
+	Short: "Show or change the password aging of an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Show or change the password aging of an user stored in the shadow file.
+
+Only the fields of the specified flags are changed. Use -1 to empty a field.
+
+	$> entities chage foo -M 90 -W 7
+	$> entities chage foo -E 2030-01-01
+	$> entities chage foo -l
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files := filesFromFlags(cmd)
+		list, _ := cmd.Flags().GetBool("list")
+
+		current, err := ParseShadow(files.Shadow)
+		if err != nil {
+			return err
+		}
+		existing, ok := current[args[0]]
+		if !ok {
+			return errors.New("User " + args[0] + " is not present in " + files.Shadow)
+		}
+
+		if list {
+			return showAging(existing)
+		}
+
+		s := Shadow{Username: existing.Username, Password: existing.Password}
+		for _, f := range []struct {
+			flag  string
+			field *string
+			parse func(string) (string, error)
+		}{
+			{"lastday", &s.LastChanged, parseShadowDate},
+			{"mindays", &s.MinimumChanged, parseShadowDays},
+			{"maxdays", &s.MaximumChanged, parseShadowDays},
+			{"warndays", &s.Warn, parseShadowDays},
+			{"inactive", &s.Inactive, parseShadowDays},
+			{"expiredate", &s.Expire, parseShadowDate},
+		} {
+			v, _ := cmd.Flags().GetString(f.flag)
+			*f.field, err = f.parse(v)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Aging fields not specified are kept by Apply
+		return s.Apply(files.Shadow, false)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(chageCmd)
+
+	var flags = chageCmd.Flags()
+	addFilesFlags(flags)
+	flags.StringP("lastday", "d", "", "Set the last password change (YYYY-MM-DD or days since 1970-01-01).")
+	flags.StringP("mindays", "m", "", "Set the minimum number of days between password changes.")
+	flags.StringP("maxdays", "M", "", "Set the maximum number of days a password is valid.")
+	flags.StringP("warndays", "W", "", "Set the number of days of warning before the password expires.")
+	flags.StringP("inactive", "I", "", "Set the number of days after the password expiration before the account is locked.")
+	flags.StringP("expiredate", "E", "", "Set the account expiration date (YYYY-MM-DD or days since 1970-01-01).")
+	flags.BoolP("list", "l", false, "Show the password aging of the user.")
+}
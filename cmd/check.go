@@ -0,0 +1,139 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	tablewriter "github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the consistency of the identity files",
+	Long: `Check validates the passwd, shadow, group and gshadow files against each other,
+as pwck and grpck do: lines with a wrong number of fields, duplicate names and ids,
+shadow entries of users or groups that don't exist, missing shadow entries, members
+that don't exist, missing home directories, shells not in /etc/shells and shadow
+files not in the order of passwd and group.
+
+With --fix the findings that have a fix are fixed: dangling entries and members are
+removed, missing entries are added locked and the shadow files are sorted. Use it
+together with --dry-run first:
+
+	$> entities check --fix --dry-run
+
+Exit with 2 if findings with error severity are left.
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "text", "json":
+		default:
+			return errors.New("Invalid output value. Admits values are: text|json.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		fix, _ := cmd.Flags().GetBool("fix")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		root, _ := cmd.Flags().GetString("root")
+
+		files := filesFromFlags(cmd)
+		opts := CheckOptions{Root: root, Fix: fix}
+
+		var findings []Finding
+		var err error
+		if dryRun {
+			var changes []FileChange
+			changes, err = Plan(files, func(t *Transaction) error {
+				findings, err = t.Check(opts)
+				return err
+			})
+			if err == nil {
+				// Nothing is written with --dry-run
+				for i := range findings {
+					findings[i].Fixed = false
+				}
+				printFindings(findings, output)
+				err = printPlan(cmd, changes)
+			}
+		} else {
+			findings, err = Check(files, opts)
+			if err == nil {
+				printFindings(findings, output)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, f := range findings {
+			if f.Severity == SeverityError && !f.Fixed {
+				os.Exit(exitFindings)
+			}
+		}
+
+		return nil
+	},
+}
+
+func printFindings(findings []Finding, output string) {
+	if output == "json" {
+		data, _ := json.Marshal(findings)
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(findings) == 0 {
+		fmt.Println("No findings.")
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorders(tablewriter.Border{
+		Left:   true,
+		Top:    true,
+		Right:  true,
+		Bottom: true,
+	})
+	table.SetColWidth(50)
+	table.SetHeader([]string{"Kind", "Name", "Severity", "Message", "Fix"})
+	for _, f := range findings {
+		fix := f.Fix
+		if f.Fixed {
+			fix += " (fixed)"
+		}
+		table.Append([]string{f.Kind, f.Name, f.Severity, f.Message, fix})
+	}
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	var flags = checkCmd.Flags()
+	flags.Bool("fix", false, "Fix the findings that have a fix.")
+	flags.Bool("dry-run", false,
+		"With --fix print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	flags.StringP("output", "o", "text", "Output format: text|json")
+	addFilesFlags(flags)
+}
@@ -17,6 +17,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	. "github.com/mudler/entities/pkg/entities"
 
@@ -24,198 +25,42 @@ import (
 	"github.com/spf13/cobra"
 )
 
-type EntityDifference struct {
-	OriginalEntity Entity `json:"originalEntity,omitempty" yaml:"originalEntity,omitempty"`
-	TargetEntity   Entity `json:"targetEntity,omitempty" yaml:"targetEntity,omitempty"`
-	Kind           string `json:"kind" yaml:"kind"`
-	Descr          string `json:"descr,omitempty" yaml:"descr,omitempty"`
-	Missing        bool   `json:"missing" yaml:"missing"`
-}
-
-func getCurrentStatus(store *EntitiesStore, usersFile, groupsFile, shadowFile, gshadowFile string) error {
-
-	mUsers, err := ParseUser(usersFile)
-	if err != nil {
-		return err
-	}
-
-	mGroups, err := ParseGroup(groupsFile)
-	if err != nil {
-		return err
-	}
-
-	mShadows, err := ParseShadow(shadowFile)
-	if err != nil {
-		return err
-	}
-
-	mGShadows, err := ParseGShadow(gshadowFile)
-	if err != nil {
-		return err
-	}
-
-	store.Users = mUsers
-	store.Groups = mGroups
-	store.Shadows = mShadows
-	store.GShadows = mGShadows
-
-	return nil
-}
-
-func compare(currentStore, store *EntitiesStore, jsonOutput bool) error {
-
-	differences := []EntityDifference{}
-
-	// Check users: I check that all entities defined in the specs are available and equal.
-	// Not in reverse.
-	for name, u := range store.Users {
-		cUser, ok := currentStore.GetUser(name)
-		if !ok {
-			differences = append(differences, EntityDifference{
-				TargetEntity: u,
-				Missing:      true,
-				Kind:         u.GetKind(),
-				Descr:        fmt.Sprintf("User %s is not present.", name),
-			})
-			continue
-		}
-
-		if (u.Uid >= 0 && cUser.Uid != u.Uid) ||
-			(u.Group == "" && cUser.Gid != u.Gid) ||
-			cUser.Homedir != u.Homedir || cUser.Shell != u.Shell {
-			differences = append(differences, EntityDifference{
-				OriginalEntity: cUser,
-				TargetEntity:   u,
-				Missing:        false,
-				Kind:           u.GetKind(),
-				Descr:          fmt.Sprintf("User %s has difference.", name),
-			})
-		}
-	}
-
-	// Check groups
-	for name, g := range store.Groups {
-		cGroup, ok := currentStore.GetGroup(name)
-		if !ok {
-			differences = append(differences, EntityDifference{
-				TargetEntity: g,
-				Missing:      true,
-				Kind:         g.GetKind(),
-				Descr:        fmt.Sprintf("Group %s is not present.", name),
-			})
-			continue
-		}
-
-		if cGroup.Password != g.Password ||
-			(g.Gid != nil && *g.Gid >= 0 && cGroup.Gid != g.Gid) ||
-			cGroup.Users != g.Users {
-			differences = append(differences, EntityDifference{
-				OriginalEntity: cGroup,
-				TargetEntity:   g,
-				Missing:        false,
-				Kind:           g.GetKind(),
-				Descr:          fmt.Sprintf("Group %s has difference.", name),
-			})
-		}
-	}
-
-	// Check shadow
-	for name, s := range store.Shadows {
-		cShadow, ok := currentStore.GetShadow(name)
-		if !ok {
-			differences = append(differences, EntityDifference{
-				TargetEntity: s,
-				Missing:      true,
-				Kind:         s.GetKind(),
-				Descr:        fmt.Sprintf("Shadow with username %s is not present.", name),
-			})
-			continue
-		}
-
-		if cShadow.MinimumChanged != s.MinimumChanged ||
-			cShadow.MaximumChanged != s.MaximumChanged ||
-			cShadow.Warn != s.Warn ||
-			cShadow.Inactive != s.Inactive ||
-			cShadow.Expire != s.Expire {
-			differences = append(differences, EntityDifference{
-				OriginalEntity: cShadow,
-				TargetEntity:   s,
-				Missing:        false,
-				Kind:           s.GetKind(),
-				Descr:          fmt.Sprintf("Shadow with user %s has difference.", name),
-			})
-		}
-	}
-
-	// Check gshadow
-	for name, s := range store.GShadows {
-		cGShadow, ok := currentStore.GetGShadow(name)
-		if !ok {
-			differences = append(differences, EntityDifference{
-				TargetEntity: s,
-				Missing:      true,
-				Kind:         s.GetKind(),
-				Descr:        fmt.Sprintf("GShadow with name %s is not present.", name),
-			})
-			continue
-		}
-
-		if cGShadow.Password != s.Password ||
-			cGShadow.Administrators != s.Administrators ||
-			cGShadow.Members != s.Members {
-			differences = append(differences, EntityDifference{
-				OriginalEntity: cGShadow,
-				TargetEntity:   s,
-				Missing:        false,
-				Kind:           s.GetKind(),
-				Descr:          fmt.Sprintf("GShadow with name %s has difference.", name),
-			})
-		}
-	}
-
+func compare(differences []Difference, jsonOutput bool) {
 	if jsonOutput {
 		data, _ := json.Marshal(differences)
 		fmt.Println(string(data))
-	} else {
-
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetBorders(tablewriter.Border{
-			Left:   true,
-			Top:    true,
-			Right:  true,
-			Bottom: true,
-		})
-		table.SetColWidth(50)
-		table.SetHeader([]string{
-			"Kind", "Name", "Missing", "Difference",
-		})
-		for _, d := range differences {
-			var name string
-			switch d.Kind {
-			case UserKind:
-				name = (d.TargetEntity.(UserPasswd)).Username
-			case ShadowKind:
-				name = (d.TargetEntity.(Shadow)).Username
-			case GroupKind:
-				name = (d.TargetEntity.(Group)).Name
-			case GShadowKind:
-				name = (d.TargetEntity.(GShadow)).Name
-			}
-
-			table.Append([]string{
-				d.Kind,
-				name,
-				fmt.Sprintf("%v", d.Missing),
-				d.Descr,
-			})
+		return
+	}
 
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorders(tablewriter.Border{
+		Left:   true,
+		Top:    true,
+		Right:  true,
+		Bottom: true,
+	})
+	table.SetColWidth(50)
+	table.SetHeader([]string{
+		"Kind", "Name", "Missing", "Unmanaged", "Difference", "Fields",
+	})
+	for _, d := range differences {
+		fields := []string{}
+		for _, f := range d.Fields {
+			fields = append(fields, f.String())
 		}
 
-		table.Render()
+		table.Append([]string{
+			d.Kind,
+			d.Name,
+			fmt.Sprintf("%v", d.Missing),
+			fmt.Sprintf("%v", d.Unmanaged),
+			d.Descr,
+			strings.Join(fields, "\n"),
+		})
 
 	}
 
-	return nil
+	table.Render()
 }
 
 var compareCmd = &cobra.Command{
@@ -224,6 +69,22 @@ var compareCmd = &cobra.Command{
 	Long: `
 Compare entities of the system with the specs available in the specified directory.
 
+With --unmanaged the entities of the system missing in the specs are reported too.
+They can be selected with --include and --exclude regexes on the name and with an
+uid or gid range, by default the one of the human users:
+
+	$> entities compare -s <specs-dir> --unmanaged --min-id 1000 --exclude '^nobody$'
+
+With --owned only the entities recorded in the state file, the ones created or
+applied by entities, are reported.
+
+Fields can be excluded from the comparison with --ignore-field (e.g. --ignore-field shell)
+and the passwords of the specs are not verified with --skip-passwords.
+
+Plaintext passwords of the specs are verified against the stored hashes, the group
+of the users is resolved by name and the ids allocated to dynamic users and groups
+(uid or gid -1) are checked against the ones recorded in the state file.
+
 To read /etc/shadow and /etc/gshadow requires root permissions.
 `,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -235,11 +96,38 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		specsdirs, _ := cmd.Flags().GetStringArray("specs-dir")
-		usersFile, _ := cmd.Flags().GetString("users-file")
-		groupsFile, _ := cmd.Flags().GetString("groups-file")
-		shadowFile, _ := cmd.Flags().GetString("shadow-file")
-		gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
 		jsonOutput, _ := cmd.Flags().GetBool("json")
+		unmanaged, _ := cmd.Flags().GetBool("unmanaged")
+		ignoreFields, _ := cmd.Flags().GetStringArray("ignore-field")
+		skipPasswords, _ := cmd.Flags().GetBool("skip-passwords")
+
+		opts := DiffOptions{
+			IgnoreFields:  ignoreFields,
+			SkipPasswords: skipPasswords,
+		}
+
+		// The state is needed only by --owned: without it the dynamic ids
+		// are not checked.
+		stateFile, _ := cmd.Flags().GetString("state-file")
+		owned, _ := cmd.Flags().GetBool("owned")
+		st, err := ReadState(stateFile)
+		if err != nil && owned {
+			return err
+		} else if err == nil {
+			opts.State = st
+		}
+
+		if unmanaged {
+			f, err := filterFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			if owned {
+				f.State = st
+			}
+			opts.Direction = DiffBoth
+			opts.Filter = f
+		}
 
 		store := NewEntitiesStore()
 		currentStore := NewEntitiesStore()
@@ -254,21 +142,19 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 		}
 
 		// Retrieve current information
-		err := getCurrentStatus(currentStore,
-			usersFile, groupsFile, shadowFile, gShadowFile,
-		)
+		files := Files{}
+		files.Passwd, _ = cmd.Flags().GetString("users-file")
+		files.Group, _ = cmd.Flags().GetString("groups-file")
+		files.Shadow, _ = cmd.Flags().GetString("shadow-file")
+		files.GShadow, _ = cmd.Flags().GetString("gshadow-file")
+		err = currentStore.LoadFiles(files)
 		if err != nil {
 			return errors.New(
 				"Error on retrieve current entities status: " + err.Error(),
 			)
 		}
 
-		err = compare(currentStore, store, jsonOutput)
-		if err != nil {
-			return errors.New(
-				"Error on compare entities stores: " + err.Error(),
-			)
-		}
+		compare(Diff(currentStore, store, opts), jsonOutput)
 
 		return nil
 	},
@@ -285,4 +171,10 @@ func init() {
 	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
 	flags.String("gshadow-file", GShadowDefault(""), "Define custom gshadow file.")
 	flags.Bool("json", false, "Show in JSON format.")
+	flags.Bool("unmanaged", false, "Report also the entities missing in the specs.")
+	flags.Bool("owned", false, "Report only the unmanaged entities owned by entities, as apply --prune removes.")
+	flags.String("state-file", StateDefault(""), "Define custom state file.")
+	flags.StringArray("ignore-field", []string{}, "Don't compare the given field (e.g. shell). Can be repeated.")
+	flags.Bool("skip-passwords", false, "Don't verify the passwords of the specs.")
+	addFilterFlags(flags)
 }
@@ -22,7 +22,10 @@ var createCmd = &cobra.Command{
 	Use:   "create",
 	Short: "create an entity",
 	Args:  cobra.MinimumNArgs(1),
-	Long:  `Create a entity to your system from yaml`,
+	Long: `Create a entity to your system from yaml.
+
+The entity is recorded in the state file of the entities owned by entities,
+unless a custom file is given with --file.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		p := &Parser{}
 
@@ -31,10 +34,30 @@ var createCmd = &cobra.Command{
 			return err
 		}
 
-		return entity.Create(entityFile)
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		t := NewTransaction(entityFilesFromFlags(cmd, entity))
+		t.Track = true
+		t.DryRun = dryRun
+		t.SetSource(entity, args[0])
+		defer t.Close()
+
+		if err := t.Create(entity); err != nil {
+			return err
+		}
+
+		if dryRun {
+			return printPlan(cmd, t.Changes())
+		}
+
+		return t.Commit()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(createCmd)
+
+	var flags = createCmd.Flags()
+	flags.Bool("dry-run", false,
+		"Print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	addFilesFlags(flags)
 }
@@ -22,7 +22,11 @@ var deleteCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "delete an entity",
 	Args:  cobra.MinimumNArgs(1),
-	Long:  `Deletes a entity to your system from a yaml`,
+	Long: `Deletes a entity to your system from a yaml.
+
+Only the entities owned by entities, recorded in the state file when created
+or applied, are deleted unless --force is used. The state is not used with
+a custom file given with --file, so --force is needed with it.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		p := &Parser{}
 
@@ -31,10 +35,28 @@ var deleteCmd = &cobra.Command{
 			return err
 		}
 
-		return entity.Delete(entityFile)
+		t := NewTransaction(entityFilesFromFlags(cmd, entity))
+		t.Force, _ = cmd.Flags().GetBool("force")
+		defer t.Close()
+
+		if err := t.Delete(entity); err != nil {
+			return err
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return printPlan(cmd, t.Changes())
+		}
+
+		return t.Commit()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(deleteCmd)
+
+	var flags = deleteCmd.Flags()
+	flags.Bool("dry-run", false,
+		"Print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	flags.Bool("force", false, "Delete the entity even if not owned by entities.")
+	addFilesFlags(flags)
 }
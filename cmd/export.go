@@ -0,0 +1,125 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the entities of the system as specs",
+	Long: `Export writes the entities of the identity files as YAML specs, by default as a
+multi-document file on stdout or with --output-dir as one file for each entity,
+named <kind>-<name>.yaml.
+
+The entities can be selected with --kind and with --include, --exclude, --min-id and
+--max-id. By default only the human users and groups are exported: use --min-id 0
+--max-id 0 to export all of them.
+
+The password hashes are exported only with --with-passwords. Without them the shadow
+and gshadow entries are exported locked ("!"), so the specs never create accounts
+without a password: use --with-passwords to apply the specs back keeping the hashes.
+
+	$> entities export --root /mnt --output-dir specs/
+	$> entities export --kind user --kind group --include '^web'
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		kinds, _ := cmd.Flags().GetStringArray("kind")
+		for _, k := range kinds {
+			switch k {
+			case UserKind, ShadowKind, GroupKind, GShadowKind:
+			default:
+				return errors.New("Invalid kind " + k + ". Admits values are: user|shadow|group|gshadow.")
+			}
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kinds, _ := cmd.Flags().GetStringArray("kind")
+		withPasswords, _ := cmd.Flags().GetBool("with-passwords")
+		outputDir, _ := cmd.Flags().GetString("output-dir")
+
+		filter, err := filterFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		current := NewEntitiesStore()
+		if err := current.LoadFiles(filesFromFlags(cmd)); err != nil {
+			return errors.New("Error on retrieve current entities status: " + err.Error())
+		}
+
+		entities := current.Export(ExportOptions{
+			Kinds:         kinds,
+			Filter:        filter,
+			WithPasswords: withPasswords,
+		})
+
+		// Specs with hashes are readable only by the owner
+		perm := os.FileMode(0644)
+		if withPasswords {
+			perm = 0600
+		}
+
+		if outputDir != "" {
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range entities {
+			data, err := MarshalEntity(e)
+			if err != nil {
+				return err
+			}
+
+			if outputDir == "" {
+				fmt.Print("---\n" + string(data))
+				continue
+			}
+
+			path := specPath(outputDir, e)
+			if err := os.WriteFile(path, data, perm); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+// specPath returns the path of the spec file of the entity in the
+// directory, named <kind>-<name>.yaml.
+func specPath(dir string, e Entity) string {
+	return filepath.Join(dir, e.GetKind()+"-"+EntityName(e)+".yaml")
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	var flags = exportCmd.Flags()
+	flags.StringArray("kind", []string{}, "Export only the entities of the kind: user|shadow|group|gshadow. Can be repeated.")
+	flags.Bool("with-passwords", false, "Export the password hashes too.")
+	flags.String("output-dir", "", "Write one spec file for each entity in the directory.")
+	addFilesFlags(flags)
+	addFilterFlags(flags)
+}
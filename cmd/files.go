@@ -0,0 +1,88 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func addFilesFlags(flags *pflag.FlagSet) {
+	flags.String("root", "", "Use the identity files under the given root directory.")
+	flags.String("users-file", "", "Define custom users file.")
+	flags.String("groups-file", "", "Define custom groups file.")
+	flags.String("shadow-file", "", "Define custom shadow file.")
+	flags.String("gshadow-file", "", "Define custom gshadow file.")
+	flags.String("state-file", "", "Define custom state file of the entities owned by entities.")
+}
+
+// filesFromFlags returns the identity files selected with the flags added
+// by addFilesFlags.
+func filesFromFlags(cmd *cobra.Command) Files {
+	root, _ := cmd.Flags().GetString("root")
+	usersFile, _ := cmd.Flags().GetString("users-file")
+	groupsFile, _ := cmd.Flags().GetString("groups-file")
+	shadowFile, _ := cmd.Flags().GetString("shadow-file")
+	gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
+	stateFile, _ := cmd.Flags().GetString("state-file")
+
+	f := NewFiles(root)
+	if usersFile != "" {
+		f.Passwd = usersFile
+	}
+	if groupsFile != "" {
+		f.Group = groupsFile
+	}
+	if shadowFile != "" {
+		f.Shadow = shadowFile
+	}
+	if gShadowFile != "" {
+		f.GShadow = gShadowFile
+	}
+	if stateFile != "" {
+		f.State = stateFile
+	}
+
+	return f
+}
+
+// entityFilesFromFlags returns the identity files selected with the flags,
+// using the file given with --file for the database of the entity. The
+// state is not used with --file.
+func entityFilesFromFlags(cmd *cobra.Command, e Entity) Files {
+	f := filesFromFlags(cmd)
+	if entityFile != "" {
+		f.SetPath(e.GetKind(), entityFile)
+		f.State = ""
+	}
+	return f
+}
+
+// printPlan prints the changes computed with --dry-run and returns the
+// error exiting with exitChanged if there are any.
+func printPlan(cmd *cobra.Command, changes []FileChange) error {
+	if len(changes) == 0 {
+		fmt.Println("No changes.")
+		return nil
+	}
+
+	for _, c := range changes {
+		fmt.Print(c.UnifiedDiff())
+	}
+	return exitWith(cmd, exitChanged)
+}
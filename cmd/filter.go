@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"regexp"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func addFilterFlags(flags *pflag.FlagSet) {
+	flags.String("include", "", "Select only the entities with name matching the regex.")
+	flags.String("exclude", "", "Ignore the entities with name matching the regex.")
+	flags.Int("min-id", HumanIDMin, "Ignore the entities with uid or gid lower than this.")
+	flags.Int("max-id", HumanIDMax, "Ignore the entities with uid or gid greater than this. 0 means no limit.")
+	flags.String("query", "", "Select only the entities matching the query (e.g. 'shell!=/sbin/nologin && member=users').")
+}
+
+// filterFromFlags returns the filter defined with the flags added by
+// addFilterFlags.
+func filterFromFlags(cmd *cobra.Command) (EntitiesFilter, error) {
+	include, _ := cmd.Flags().GetString("include")
+	exclude, _ := cmd.Flags().GetString("exclude")
+	minID, _ := cmd.Flags().GetInt("min-id")
+	maxID, _ := cmd.Flags().GetInt("max-id")
+	query, _ := cmd.Flags().GetString("query")
+
+	f := EntitiesFilter{MinID: minID, MaxID: maxID}
+
+	var err error
+	if include != "" {
+		if f.Include, err = regexp.Compile(include); err != nil {
+			return f, errors.New("Invalid include regex: " + err.Error())
+		}
+	}
+	if exclude != "" {
+		if f.Exclude, err = regexp.Compile(exclude); err != nil {
+			return f, errors.New("Invalid exclude regex: " + err.Error())
+		}
+	}
+	if query != "" {
+		if f.Query, err = ParseQuery(query); err != nil {
+			return f, errors.New("Invalid query: " + err.Error())
+		}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var fmtCmd = &cobra.Command{
+	Use:   "fmt",
+	Short: "Normalise and sort the identity files",
+	Long: `Fmt rewrites the passwd, shadow, group and gshadow files removing exact duplicate
+lines, empty lines and carriage returns. Users and groups are sorted by id, or by
+name with --sort name, keeping the system accounts first, and shadow and gshadow
+follow the order of passwd and group, as pwck -s and grpck -s do.
+
+With --check nothing is written: the files to format are listed and the command
+exits with 2 if there are any. With --dry-run the changes are printed as a diff.
+
+	$> entities fmt --check
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		sortBy, _ := cmd.Flags().GetString("sort")
+		switch sortBy {
+		case FormatByID, FormatByName:
+		default:
+			return errors.New("Invalid sort value. Admits values are: id|name.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sortBy, _ := cmd.Flags().GetString("sort")
+		check, _ := cmd.Flags().GetBool("check")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		files := filesFromFlags(cmd)
+		opts := FormatOptions{SortBy: sortBy}
+
+		if !check && !dryRun {
+			return Format(files, opts)
+		}
+
+		changes, err := Plan(files, func(t *Transaction) error {
+			return t.Format(opts)
+		})
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			return printPlan(cmd, changes)
+		}
+
+		for _, c := range changes {
+			fmt.Println(c.Path)
+		}
+		if len(changes) > 0 {
+			os.Exit(exitChanged)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fmtCmd)
+
+	var flags = fmtCmd.Flags()
+	flags.String("sort", FormatByID, "Order of the users and groups: id|name")
+	flags.Bool("check", false, "List the files to format without writing them. Exit with 2 if there are any.")
+	flags.Bool("dry-run", false,
+		"Print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	addFilesFlags(flags)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var getCmd = &cobra.Command{
+	Use:   "get <user|group|shadow|gshadow> <name-or-id>",
+	Short: "Show a single entity of the system",
+	Args:  cobra.ExactArgs(2),
+	Long: `Get finds an entity of the identity files by name or, if there is none, by
+numeric uid or gid and prints it as a spec, in YAML or JSON. With --field only the
+value of the given spec field is printed. Shadow and gshadow entries are found by
+the id of their user or group. The passwords are redacted, as list does, unless
+--show-passwords is used.
+
+Exit with 2 if the entity is not found.
+
+	$> entities get user 1000 --field homedir
+	$> entities get group wheel -o json
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		switch args[0] {
+		case UserKind, ShadowKind, GroupKind, GShadowKind:
+		default:
+			return errors.New("Invalid kind " + args[0] + ". Admits values are: user|shadow|group|gshadow.")
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "yaml", "json":
+		default:
+			return errors.New("Invalid output value. Admits values are: yaml|json.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		field, _ := cmd.Flags().GetString("field")
+
+		current, err := loadKind(filesFromFlags(cmd), args[0])
+		if err != nil {
+			return errors.New("Error on retrieve current entities status: " + err.Error())
+		}
+
+		e, ok := current.Find(args[0], args[1])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "The %s %s is not present.\n", args[0], args[1])
+			os.Exit(exitNotFound)
+		}
+		if show, _ := cmd.Flags().GetBool("show-passwords"); !show {
+			e = RedactEntity(e)
+		}
+
+		data, err := MarshalEntity(e)
+		if err != nil {
+			return err
+		}
+
+		if field == "" && output == "yaml" {
+			fmt.Print(string(data))
+			return nil
+		}
+
+		spec := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &spec); err != nil {
+			return err
+		}
+
+		if field != "" {
+			v, ok := spec[field]
+			if !ok {
+				return errors.New("Invalid field " + field + " for kind " + args[0])
+			}
+			if v != nil {
+				fmt.Println(v)
+			} else {
+				fmt.Println()
+			}
+			return nil
+		}
+
+		data, _ = json.Marshal(spec)
+		fmt.Println(string(data))
+
+		return nil
+	},
+}
+
+// loadKind reads the database of the kind and the one with the ids of its
+// entities, so that only root can read shadow and gshadow.
+func loadKind(f Files, kind string) (*EntitiesStore, error) {
+	s := NewEntitiesStore()
+
+	var err error
+	switch kind {
+	case UserKind, ShadowKind:
+		if s.Users, err = ParseUser(f.Passwd); err != nil {
+			return nil, err
+		}
+	case GroupKind, GShadowKind:
+		if s.Groups, err = ParseGroup(f.Group); err != nil {
+			return nil, err
+		}
+	}
+
+	switch kind {
+	case ShadowKind:
+		s.Shadows, err = ParseShadow(f.Shadow)
+	case GShadowKind:
+		s.GShadows, err = ParseGShadow(f.GShadow)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func init() {
+	rootCmd.AddCommand(getCmd)
+
+	var flags = getCmd.Flags()
+	flags.StringP("output", "o", "yaml", "Output format: yaml|json")
+	flags.String("field", "", "Print only the value of the spec field (e.g. homedir).")
+	flags.Bool("show-passwords", false, "Show the passwords instead of redacting them.")
+	addFilesFlags(flags)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var groupaddCmd = &cobra.Command{
+	Use:   "groupadd <group>",
+	Short: "Add a group",
+	Args:  cobra.ExactArgs(1),
+	Long: `Groupadd adds a group and its gshadow entry, with a locked password, as
+groupadd(8) does. The gid is allocated from the range of the human users or, with
+--system, from the one of the system accounts.
+
+With --spec-dir the specs of the entities written are written in the directory too.
+
+	$> entities groupadd -g 2000 --spec-dir specs/ developers
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := GroupAddOptions{Gid: idFromFlag(cmd, "gid")}
+		opts.System, _ = cmd.Flags().GetBool("system")
+
+		_, _, err := runAccount(cmd, func(t *Transaction) (AccountChanges, error) {
+			return t.GroupAdd(args[0], opts)
+		})
+		return err
+	},
+}
+
+var groupdelCmd = &cobra.Command{
+	Use:   "groupdel <group>",
+	Short: "Delete a group",
+	Args:  cobra.ExactArgs(1),
+	Long: `Groupdel deletes a group and its gshadow entry as groupdel(8) does. The primary
+group of an user can't be deleted.
+
+Only the groups owned by entities, recorded in the state file, are deleted unless
+--force is used. With --spec-dir the specs of the deleted entities are removed from
+the directory.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, _, err := runAccount(cmd, func(t *Transaction) (AccountChanges, error) {
+			return t.GroupDel(args[0])
+		})
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(groupaddCmd)
+	rootCmd.AddCommand(groupdelCmd)
+
+	var flags = groupaddCmd.Flags()
+	flags.IntP("gid", "g", 0, "Gid of the group. Allocated if not given.")
+	flags.BoolP("system", "r", false, "Allocate the gid in the range of the system accounts.")
+	addAccountFlags(flags)
+
+	flags = groupdelCmd.Flags()
+	flags.Bool("force", false, "Delete the group even if not owned by entities.")
+	addAccountFlags(flags)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+type idGroup struct {
+	Name string `json:"name"`
+	Gid  int    `json:"gid"`
+}
+
+type idResult struct {
+	Name   string    `json:"name"`
+	Uid    int       `json:"uid"`
+	Gid    int       `json:"gid"`
+	Groups []idGroup `json:"groups"`
+}
+
+func validateTextOutput(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	switch output {
+	case "text", "json":
+	default:
+		return errors.New("Invalid output value. Admits values are: text|json.")
+	}
+	return nil
+}
+
+// loadMembership reads passwd and group and, if readable, gshadow: its
+// members are considered only when running as root.
+func loadMembership(f Files) (*EntitiesStore, error) {
+	s := NewEntitiesStore()
+
+	var err error
+	if s.Users, err = ParseUser(f.Passwd); err != nil {
+		return nil, err
+	}
+	if s.Groups, err = ParseGroup(f.Group); err != nil {
+		return nil, err
+	}
+	if gshadows, err := ParseGShadow(f.GShadow); err == nil {
+		s.GShadows = gshadows
+	}
+
+	return s, nil
+}
+
+// idString formats an id with its name as id(1) does.
+func idString(id int, name string) string {
+	if name == "" {
+		return strconv.Itoa(id)
+	}
+	return fmt.Sprintf("%d(%s)", id, name)
+}
+
+var idCmd = &cobra.Command{
+	Use:   "id <user>",
+	Short: "Show the uid and the groups of a user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Id prints the uid, the primary group and the supplementary groups of a user,
+as id(1) does, from the identity files. The supplementary groups are the ones
+listing the user in the group file or, when readable, in the gshadow file.
+
+	$> entities id foo
+	uid=1000(foo) gid=1000(foo) groups=1000(foo),10(wheel)
+`,
+	PreRunE: validateTextOutput,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+
+		store, err := loadMembership(filesFromFlags(cmd))
+		if err != nil {
+			return err
+		}
+
+		groups, err := store.GroupsOf(args[0])
+		if err != nil {
+			return err
+		}
+
+		u := store.Users[args[0]]
+		res := idResult{Name: u.Username, Uid: u.Uid, Gid: u.Gid, Groups: []idGroup{}}
+		for _, g := range groups {
+			res.Groups = append(res.Groups, idGroup{Name: g.Name, Gid: *g.Gid})
+		}
+
+		if output == "json" {
+			data, _ := json.Marshal(res)
+			fmt.Println(string(data))
+			return nil
+		}
+
+		ids := []string{}
+		for _, g := range res.Groups {
+			ids = append(ids, idString(g.Gid, g.Name))
+		}
+		fmt.Printf("uid=%s gid=%s groups=%s\n",
+			idString(res.Uid, res.Name), idString(res.Gid, res.Groups[0].Name), strings.Join(ids, ","))
+
+		return nil
+	},
+}
+
+var membersCmd = &cobra.Command{
+	Use:   "members <group>",
+	Short: "List the members of a group",
+	Args:  cobra.ExactArgs(1),
+	Long: `Members lists the users with the group as primary group, marked as primary,
+followed by the ones listed in the group file or, when readable, in the gshadow file.
+`,
+	PreRunE: validateTextOutput,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+
+		store, err := loadMembership(filesFromFlags(cmd))
+		if err != nil {
+			return err
+		}
+
+		members, err := store.Members(args[0])
+		if err != nil {
+			return err
+		}
+
+		if output == "json" {
+			data, _ := json.Marshal(members)
+			fmt.Println(string(data))
+			return nil
+		}
+
+		for _, m := range members {
+			if m.Primary {
+				fmt.Println(m.Name + " (primary)")
+			} else {
+				fmt.Println(m.Name)
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(idCmd)
+	rootCmd.AddCommand(membersCmd)
+
+	for _, c := range []*cobra.Command{idCmd, membersCmd} {
+		var flags = c.Flags()
+		flags.StringP("output", "o", "text", "Output format: text|json")
+		addFilesFlags(flags)
+	}
+}
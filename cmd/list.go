@@ -14,37 +14,168 @@ limitations under the License.
 package cmd
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"regexp"
 	"sort"
-	"strconv"
-	"time"
+	"strings"
+	"text/template"
 
 	. "github.com/mudler/entities/pkg/entities"
 
 	tablewriter "github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
-func filterMatch(filter, field string) bool {
-	if filter == "" {
-		return true
-	}
+// listOptions defines the output of the list subcommands.
+type listOptions struct {
+	Order string
+	// Regex on the entity names, compiled once
+	Filter *regexp.Regexp
+	// Query matched against the entities of Store
+	Query *Query
+	Store *EntitiesStore
+	// table, json, yaml, csv or template=<go-template>
+	Output        string
+	ShowPasswords bool
+}
 
-	r := regexp.MustCompile(filter)
-	if r != nil {
-		if r.MatchString(field) {
-			return true
+func validateListOutput(output string) error {
+	switch {
+	case output == "table", output == "json", output == "yaml", output == "csv":
+	case strings.HasPrefix(output, "template="):
+		if _, err := template.New("list").Parse(strings.TrimPrefix(output, "template=")); err != nil {
+			return errors.New("Invalid template: " + err.Error())
 		}
+	default:
+		return errors.New("Invalid output value. Admits values are: table|json|yaml|csv|template=<go-template>.")
+	}
+	return nil
+}
+
+// match reports whether the entity of the kind with the name is selected
+// by --filter and --query.
+func (o listOptions) match(kind, name string) bool {
+	if o.Filter != nil && !o.Filter.MatchString(name) {
 		return false
 	}
-	return true
+	return o.Query == nil || o.Query.Match(o.Store, kind, name)
+}
+
+// loadQueryStore reads the identity files for the queries. The ones that
+// can't be read, as shadow and gshadow when not running as root, are left
+// empty and their fields don't match.
+func loadQueryStore(f Files) *EntitiesStore {
+	s := NewEntitiesStore()
+	if users, err := ParseUser(f.Passwd); err == nil {
+		s.Users = users
+	}
+	if groups, err := ParseGroup(f.Group); err == nil {
+		s.Groups = groups
+	}
+	if shadows, err := ParseShadow(f.Shadow); err == nil {
+		s.Shadows = shadows
+	}
+	if gshadows, err := ParseGShadow(f.GShadow); err == nil {
+		s.GShadows = gshadows
+	}
+	return s
+}
+
+// password returns the password to show, redacted unless requested.
+func (o listOptions) password(p string) string {
+	if o.ShowPasswords {
+		return p
+	}
+	return RedactPassword(p)
+}
+
+// specFields returns the spec fields of the entity, in the spec order.
+func specFields(e Entity) ([]string, map[string]interface{}, error) {
+	var node yaml.Node
+	if err := node.Encode(e); err != nil {
+		return nil, nil, err
+	}
+
+	keys := []string{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i].Value)
+	}
+
+	values := map[string]interface{}{}
+	if err := node.Decode(&values); err != nil {
+		return nil, nil, err
+	}
+
+	return keys, values, nil
 }
 
-func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool) error {
+// printEntities prints the entities in the output format, except table,
+// with the field names of the spec format.
+func printEntities(entities []Entity, opts listOptions) error {
+	if !opts.ShowPasswords {
+		for i, e := range entities {
+			entities[i] = RedactEntity(e)
+		}
+	}
+
+	switch {
+	case opts.Output == "json":
+		data, _ := json.Marshal(entities)
+		fmt.Println(string(data))
+	case opts.Output == "yaml":
+		data, err := yaml.Marshal(entities)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+	case opts.Output == "csv":
+		w := csv.NewWriter(os.Stdout)
+		for i, e := range entities {
+			keys, values, err := specFields(e)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				w.Write(keys)
+			}
+			row := []string{}
+			for _, k := range keys {
+				if values[k] == nil {
+					row = append(row, "")
+				} else {
+					row = append(row, fmt.Sprintf("%v", values[k]))
+				}
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		tmpl, err := template.New("list").Parse(strings.TrimPrefix(opts.Output, "template="))
+		if err != nil {
+			return err
+		}
+		for _, e := range entities {
+			_, values, err := specFields(e)
+			if err != nil {
+				return err
+			}
+			if err := tmpl.Execute(os.Stdout, values); err != nil {
+				return err
+			}
+			fmt.Println()
+		}
+	}
+
+	return nil
+}
+
+func listGroups(file string, opts listOptions, groupHasShadow bool) error {
 	var err error
 	var mGShadows map[string]GShadow
 
@@ -59,9 +190,9 @@ func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool) err
 	groups := []string{}
 	mGids := make(map[string]Group, 0)
 
-	if order == "name" {
+	if opts.Order == "name" {
 		for k, _ := range mGroups {
-			if filterMatch(filter, k) {
+			if opts.match(GroupKind, k) {
 				groups = append(groups, k)
 			}
 		}
@@ -71,7 +202,7 @@ func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool) err
 		gidList := []int{}
 
 		for k, _ := range mGroups {
-			if filterMatch(filter, k) {
+			if opts.match(GroupKind, k) {
 				gid := fmt.Sprintf("%d", *mGroups[k].Gid)
 				mGids[gid] = mGroups[k]
 				gidList = append(gidList, *mGroups[k].Gid)
@@ -84,20 +215,19 @@ func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool) err
 		}
 	}
 
-	if jsonOutput {
-		res := []Group{}
+	if opts.Output != "table" {
+		res := []Entity{}
 
 		for _, group := range groups {
 			gName := group
-			if order == "id" {
+			if opts.Order == "id" {
 				gName = mGids[group].Name
 			}
 
 			res = append(res, mGroups[gName])
 		}
 
-		data, _ := json.Marshal(res)
-		fmt.Println(string(data))
+		return printEntities(res, opts)
 
 	} else {
 
@@ -127,12 +257,12 @@ func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool) err
 
 		for _, group := range groups {
 			gName := group
-			if order == "id" {
+			if opts.Order == "id" {
 				gName = mGids[group].Name
 			}
 			row := []string{
 				mGroups[gName].Name,
-				mGroups[gName].Password,
+				opts.password(mGroups[gName].Password),
 				fmt.Sprintf("%d", *mGroups[gName].Gid),
 				mGroups[gName].Users,
 			}
@@ -153,7 +283,7 @@ func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool) err
 	return nil
 }
 
-func listShadows(file, order, filter string, jsonOutput, humanReadable bool) error {
+func listShadows(file string, opts listOptions, humanReadable bool) error {
 	file = ShadowDefault(file)
 
 	mShadows, err := ParseShadow(file)
@@ -165,39 +295,29 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool) err
 	shadows := []string{}
 
 	for k, _ := range mShadows {
-		if filterMatch(filter, k) {
+		if opts.match(ShadowKind, k) {
 			shadows = append(shadows, k)
 		}
 	}
 	sort.Strings(shadows)
 
-	if jsonOutput {
-		res := []Shadow{}
+	if opts.Output != "table" {
+		res := []Entity{}
 
 		for _, s := range shadows {
 
 			lastChanged := mShadows[s].LastChanged
+			expire := mShadows[s].Expire
 			if humanReadable {
-				i, err := strconv.Atoi(lastChanged)
+				var err error
+				lastChanged, err = ShadowDate(lastChanged)
 				if err != nil {
 					return err
 				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				lctime := time.Unix(unixSec, 0)
-				lastChanged = lctime.Format("2006-01-02T15:04:05Z")
-			}
-
-			expire := mShadows[s].Expire
-			if humanReadable && expire != "" {
-				i, err := strconv.Atoi(expire)
+				expire, err = ShadowDate(expire)
 				if err != nil {
 					return err
 				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				extime := time.Unix(unixSec, 0)
-				expire = extime.Format("2006-01-02T15:04:05Z")
 			}
 
 			shadow := mShadows[s]
@@ -207,8 +327,7 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool) err
 			res = append(res, shadow)
 		}
 
-		data, _ := json.Marshal(res)
-		fmt.Println(string(data))
+		return printEntities(res, opts)
 
 	} else {
 		table := tablewriter.NewWriter(os.Stdout)
@@ -227,33 +346,23 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool) err
 
 		for _, s := range shadows {
 
-			pass := mShadows[s].Password
+			pass := opts.password(mShadows[s].Password)
 			if len(pass) > 60 {
 				pass = pass[0:60] + "\n" + pass[60:]
 			}
 
 			lastChanged := mShadows[s].LastChanged
+			expire := mShadows[s].Expire
 			if humanReadable {
-				i, err := strconv.Atoi(lastChanged)
+				var err error
+				lastChanged, err = ShadowDate(lastChanged)
 				if err != nil {
 					return err
 				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				lctime := time.Unix(unixSec, 0)
-				lastChanged = lctime.Format("2006-01-02T15:04:05Z")
-			}
-
-			expire := mShadows[s].Expire
-			if humanReadable && expire != "" {
-				i, err := strconv.Atoi(expire)
+				expire, err = ShadowDate(expire)
 				if err != nil {
 					return err
 				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				extime := time.Unix(unixSec, 0)
-				expire = extime.Format("2006-01-02T15:04:05Z")
 			}
 
 			table.Append([]string{
@@ -275,7 +384,7 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool) err
 	return nil
 }
 
-func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error {
+func listUsers(file string, opts listOptions, userHasShadow bool) error {
 	file = UserDefault(file)
 
 	mUsers, err := ParseUser(file)
@@ -287,9 +396,9 @@ func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error
 	users := []string{}
 	mUids := make(map[string]UserPasswd, 0)
 
-	if order == "name" {
+	if opts.Order == "name" {
 		for k, _ := range mUsers {
-			if filterMatch(filter, k) {
+			if opts.match(UserKind, k) {
 				users = append(users, k)
 			}
 		}
@@ -299,7 +408,7 @@ func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error
 		uidList := []int{}
 
 		for k, _ := range mUsers {
-			if filterMatch(filter, k) {
+			if opts.match(UserKind, k) {
 				uid := fmt.Sprintf("%d", mUsers[k].Uid)
 				mUids[uid] = mUsers[k]
 				uidList = append(uidList, mUsers[k].Uid)
@@ -312,20 +421,19 @@ func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error
 		}
 	}
 
-	if jsonOutput {
-		res := []UserPasswd{}
+	if opts.Output != "table" {
+		res := []Entity{}
 
 		for _, user := range users {
 			uName := user
-			if order == "id" {
+			if opts.Order == "id" {
 				uName = mUids[user].Username
 			}
 
 			res = append(res, mUsers[uName])
 		}
 
-		data, _ := json.Marshal(res)
-		fmt.Println(string(data))
+		return printEntities(res, opts)
 
 	} else {
 
@@ -354,7 +462,7 @@ func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error
 
 		for _, user := range users {
 			uName := user
-			if order == "id" {
+			if opts.Order == "id" {
 				uName = mUids[user].Username
 			}
 
@@ -362,7 +470,7 @@ func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error
 
 			row := []string{
 				mUsers[uName].Username,
-				mUsers[uName].Password,
+				opts.password(mUsers[uName].Password),
 				fmt.Sprintf("%d", mUsers[uName].Uid),
 				fmt.Sprintf("%d", mUsers[uName].Gid),
 				mUsers[uName].Info,
@@ -383,7 +491,7 @@ func listUsers(file, order, filter string, jsonOutput, userHasShadow bool) error
 	return nil
 }
 
-func listGshadows(file, order, filter string, jsonOutput bool) error {
+func listGshadows(file string, opts listOptions) error {
 	file = GShadowDefault(file)
 
 	mGShadows, err := ParseGShadow(file)
@@ -395,21 +503,20 @@ func listGshadows(file, order, filter string, jsonOutput bool) error {
 	gshadows := []string{}
 
 	for k, _ := range mGShadows {
-		if filterMatch(filter, k) {
+		if opts.match(GShadowKind, k) {
 			gshadows = append(gshadows, k)
 		}
 	}
 	sort.Strings(gshadows)
 
-	if jsonOutput {
-		res := []GShadow{}
+	if opts.Output != "table" {
+		res := []Entity{}
 
 		for _, s := range gshadows {
 			res = append(res, mGShadows[s])
 		}
 
-		data, _ := json.Marshal(res)
-		fmt.Println(string(data))
+		return printEntities(res, opts)
 
 	} else {
 		table := tablewriter.NewWriter(os.Stdout)
@@ -427,7 +534,7 @@ func listGshadows(file, order, filter string, jsonOutput bool) error {
 
 		for _, s := range gshadows {
 
-			pass := mGShadows[s].Password
+			pass := opts.password(mGShadows[s].Password)
 			if len(pass) > 60 {
 				pass = pass[0:60] + "\n" + pass[60:]
 			}
@@ -451,7 +558,22 @@ var listCmd = &cobra.Command{
 	Use:   "list <shadow|groups|users|gshadow>",
 	Short: "Show entities availables",
 	Args:  cobra.MinimumNArgs(1),
-	Long:  `Show the list of entities applied on current system.`,
+	Long: `Show the list of entities applied on current system.
+
+With --output the entities are printed as table, json, yaml, csv or with a Go
+template executed for each entity, e.g. --output 'template={{.username}} {{.uid}}'.
+All the formats but table use the field names of the specs. The passwords are
+redacted unless --show-passwords is used.
+
+With --query the entities are selected by their fields, joined with the ones of
+the shadow entries and of the groups:
+
+	$> entities list users -q 'uid>=1000 && shell!=/sbin/nologin'
+	$> entities list users -q 'member=wheel || expired=true'
+	$> entities list groups -q 'gid<1000 && member~^svc-'
+
+The operators are = != < <= > >= and ~ !~ for regexes, joined by && and ||,
+negated with ! and grouped with parentheses. The fields are: ` + strings.Join(QueryFields, ", ") + `.`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return errors.New("Missing mandatory argument")
@@ -473,28 +595,63 @@ var listCmd = &cobra.Command{
 				"Invalid order value. Admits values are: name|id.",
 			)
 		}
-		return nil
+
+		output, _ := cmd.Flags().GetString("output")
+		return validateListOutput(output)
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var ans error
 		etype := args[0]
 		file, _ := cmd.Flags().GetString("file")
-		order, _ := cmd.Flags().GetString("sort")
-		filter, _ := cmd.Flags().GetString("filter")
 		jsonOutput, _ := cmd.Flags().GetBool("json")
 		shadowHumanReadable, _ := cmd.Flags().GetBool("shadow-human-readable")
 		userHasShadow, _ := cmd.Flags().GetBool("user-has-shadow")
 		groupHasShadow, _ := cmd.Flags().GetBool("group-has-shadow")
 
+		opts := listOptions{}
+		opts.Order, _ = cmd.Flags().GetString("sort")
+		filter, _ := cmd.Flags().GetString("filter")
+		query, _ := cmd.Flags().GetString("query")
+		opts.Output, _ = cmd.Flags().GetString("output")
+		opts.ShowPasswords, _ = cmd.Flags().GetBool("show-passwords")
+		if jsonOutput {
+			opts.Output = "json"
+		}
+
+		var err error
+		if filter != "" {
+			if opts.Filter, err = regexp.Compile(filter); err != nil {
+				return errors.New("Invalid filter regex: " + err.Error())
+			}
+		}
+		if query != "" {
+			if opts.Query, err = ParseQuery(query); err != nil {
+				return errors.New("Invalid query: " + err.Error())
+			}
+			// The listed file replaces the default one of its kind
+			files := NewFiles("")
+			switch etype {
+			case "users":
+				files.Passwd = UserDefault(file)
+			case "groups":
+				files.Group = GroupsDefault(file)
+			case "shadow":
+				files.Shadow = ShadowDefault(file)
+			case "gshadow":
+				files.GShadow = GShadowDefault(file)
+			}
+			opts.Store = loadQueryStore(files)
+		}
+
 		switch etype {
 		case "groups":
-			ans = listGroups(file, order, filter, jsonOutput, groupHasShadow)
+			ans = listGroups(file, opts, groupHasShadow)
 		case "shadow":
-			ans = listShadows(file, order, filter, jsonOutput, shadowHumanReadable)
+			ans = listShadows(file, opts, shadowHumanReadable)
 		case "users":
-			ans = listUsers(file, order, filter, jsonOutput, userHasShadow)
+			ans = listUsers(file, opts, userHasShadow)
 		case "gshadow":
-			ans = listGshadows(file, order, filter, jsonOutput)
+			ans = listGshadows(file, opts)
 		default:
 			return errors.New("Unexpected entity type " + etype)
 		}
@@ -509,7 +666,10 @@ func init() {
 	var flags = listCmd.Flags()
 	flags.StringP("sort", "s", "name", "Sort list by: name|id")
 	flags.String("filter", "", "Filter entities by name. It uses the filter as regex")
-	flags.Bool("json", false, "Show in JSON format.")
+	flags.StringP("query", "q", "", "Show only the entities matching the query (e.g. 'uid>=1000 && shell!=/sbin/nologin').")
+	flags.StringP("output", "o", "table", "Output format: table|json|yaml|csv|template=<go-template>")
+	flags.Bool("json", false, "Show in JSON format. Same as --output json.")
+	flags.Bool("show-passwords", false, "Show the passwords instead of redacting them.")
 	flags.Bool("shadow-human-readable", false, "Show shadow days in human readable format.")
 	flags.Bool("user-has-shadow", false, "Check if exists a map of the users in the /etc/shadow file. (Available only in table format)")
 	flags.Bool("group-has-shadow", false, "Check if exists a map of the users in the /etc/gshadow file. (Available only in table format)")
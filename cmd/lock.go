@@ -0,0 +1,78 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	. "github.com/mudler/entities/pkg/entities"
+	"github.com/spf13/cobra"
+)
+
+var lockCmd = &cobra.Command{
+	Use:   "lock <user>",
+	Short: "Lock the password of an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Lock the password of an user prefixing it with "!" in the shadow file.
+
+The password can be restored with the unlock command.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		expire, _ := cmd.Flags().GetBool("expire")
+		nologin, _ := cmd.Flags().GetBool("nologin")
+
+		return LockAccount(filesFromFlags(cmd), args[0], LockOptions{
+			Expire:  expire,
+			NoLogin: nologin,
+		})
+	},
+}
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock <user>",
+	Short: "Unlock the password of an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Unlock the password of an user locked with the lock command,
+restoring the password the user had before.
+
+The account expiration and the shell are not restored.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return UnlockAccount(filesFromFlags(cmd), args[0])
+	},
+}
+
+var disableCmd = &cobra.Command{
+	Use:   "disable <user>",
+	Short: "Disable an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Disable an user locking the password, expiring the account
+and setting ` + NoLoginShell + ` as shell.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return DisableAccount(filesFromFlags(cmd), args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+	rootCmd.AddCommand(unlockCmd)
+	rootCmd.AddCommand(disableCmd)
+
+	var flags = lockCmd.Flags()
+	addFilesFlags(flags)
+	flags.Bool("expire", false, "Expire the account too.")
+	flags.Bool("nologin", false, "Set "+NoLoginShell+" as shell of the user.")
+
+	addFilesFlags(unlockCmd.Flags())
+	addFilesFlags(disableCmd.Flags())
+}
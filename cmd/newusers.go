@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var newusersCmd = &cobra.Command{
+	Use:   "newusers <file|->",
+	Short: "Create users in batch",
+	Args:  cobra.ExactArgs(1),
+	Long: `Create users in batch from a file with passwd-style lines:
+
+	name:password:uid:gid:gecos:home:shell
+
+An empty uid is allocated dynamically. The gid can be a group name or a number,
+missing groups are created. An empty gid creates a group with the name of the user.
+The password is written hashed in the shadow file.
+
+Lines with errors are reported and skipped, the others are applied.
+
+	$> entities newusers users.txt
+	$> cat users.txt | entities newusers -
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		lineErrors, err := NewUsers(filesFromFlags(cmd), r)
+		for _, e := range lineErrors {
+			fmt.Fprintln(os.Stderr, e.Error())
+		}
+		if err != nil {
+			return err
+		}
+		if len(lineErrors) > 0 {
+			return errors.New(fmt.Sprintf("%d lines not applied", len(lineErrors)))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(newusersCmd)
+
+	addFilesFlags(newusersCmd.Flags())
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func policyFromFlags(cmd *cobra.Command) (*PasswordPolicy, error) {
+	policyFile, _ := cmd.Flags().GetString("policy")
+	if policyFile == "" {
+		return nil, nil
+	}
+	return ReadPasswordPolicy(policyFile)
+}
+
+// readPassword reads the password from the terminal without echo, or the
+// first line of stdin when it isn't a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	pwd, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Retype new password: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(pwd) != string(again) {
+		return "", errors.New("Passwords don't match")
+	}
+
+	return string(pwd), nil
+}
+
+// readCredentials parses user:password lines.
+func readCredentials(r io.Reader) ([]Credential, error) {
+	creds := []Credential{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		fs := strings.SplitN(line, ":", 2)
+		if len(fs) != 2 || fs[0] == "" {
+			return nil, fmt.Errorf("Invalid line %d: expected user:password", n)
+		}
+		creds = append(creds, Credential{Username: fs[0], Password: fs[1]})
+	}
+
+	return creds, scanner.Err()
+}
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd <user>",
+	Short: "Set the password of an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Set the password of an user in the shadow file.
+
+The password is read from the terminal or from the first line of stdin.
+
+	$> echo "secret" | entities passwd foo
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policy, err := policyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		pwd, err := readPassword()
+		if err != nil {
+			return err
+		}
+
+		return SetPasswords(filesFromFlags(cmd),
+			[]Credential{{Username: args[0], Password: pwd}},
+			PasswordOptions{Policy: policy},
+		)
+	},
+}
+
+var chpasswdCmd = &cobra.Command{
+	Use:   "chpasswd",
+	Short: "Set the passwords of multiple users",
+	Args:  cobra.NoArgs,
+	Long: `Set the passwords of multiple users reading user:password lines from stdin.
+
+All the passwords are written at once. If a password can't be set, nothing is written.
+
+	$> cat passwords | entities chpasswd
+	$> echo 'foo:$6$...' | entities chpasswd --encrypted
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		encrypted, _ := cmd.Flags().GetBool("encrypted")
+
+		policy, err := policyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		creds, err := readCredentials(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		return SetPasswords(filesFromFlags(cmd), creds, PasswordOptions{
+			Hashed: encrypted,
+			Policy: policy,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(passwdCmd)
+	rootCmd.AddCommand(chpasswdCmd)
+
+	var flags = passwdCmd.Flags()
+	addFilesFlags(flags)
+	flags.String("policy", "", "Check the passwords with the given password policy file.")
+
+	flags = chpasswdCmd.Flags()
+	addFilesFlags(flags)
+	flags.String("policy", "", "Check the passwords with the given password policy file.")
+	flags.BoolP("encrypted", "e", false, "The passwords are already hashed.")
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	tablewriter "github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+type expiryRow struct {
+	Username         string `json:"username"`
+	Uid              string `json:"uid"`
+	Shell            string `json:"shell"`
+	Status           string `json:"status"`
+	PasswordExpires  string `json:"password_expires"`
+	PasswordInactive string `json:"password_inactive"`
+	AccountExpires   string `json:"account_expires"`
+}
+
+// parseWindow parses a duration supporting days (14d) and weeks (2w)
+// other than the units of time.ParseDuration.
+func parseWindow(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil {
+				return 0, errors.New("Invalid duration " + s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+func formatDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+func reportExpiry(files Files, within time.Duration, output string, includeLocked bool) error {
+	mShadows, err := ParseShadow(files.Shadow)
+	if err != nil {
+		return err
+	}
+
+	mUsers, err := ParseUser(files.Passwd)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for k := range mShadows {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	rows := []expiryRow{}
+	for _, name := range names {
+		s := mShadows[name]
+		if !includeLocked && (s.Password == "" || strings.HasPrefix(s.Password, "!") ||
+			strings.HasPrefix(s.Password, "*")) {
+			continue
+		}
+
+		e, err := ShadowExpiry(s, now, within)
+		if err != nil {
+			return errors.New("Invalid shadow entry of " + name + ": " + err.Error())
+		}
+		if e.Status == ExpiryOK {
+			continue
+		}
+
+		row := expiryRow{
+			Username:         name,
+			Status:           string(e.Status),
+			PasswordExpires:  formatDate(e.PasswordExpires),
+			PasswordInactive: formatDate(e.PasswordInactive),
+			AccountExpires:   formatDate(e.AccountExpires),
+		}
+		if u, ok := mUsers[name]; ok {
+			row.Uid = fmt.Sprintf("%d", u.Uid)
+			row.Shell = u.Shell
+		}
+		rows = append(rows, row)
+	}
+
+	headers := []string{
+		"Username", "User ID", "Shell", "Status",
+		"Password Expires", "Password Inactive", "Account Expires",
+	}
+
+	switch output {
+	case "json":
+		data, _ := json.Marshal(rows)
+		fmt.Println(string(data))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(headers)
+		for _, r := range rows {
+			w.Write([]string{
+				r.Username, r.Uid, r.Shell, r.Status,
+				r.PasswordExpires, r.PasswordInactive, r.AccountExpires,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetBorders(tablewriter.Border{
+			Left:   true,
+			Top:    true,
+			Right:  true,
+			Bottom: true,
+		})
+		table.SetHeader(headers)
+		for _, r := range rows {
+			table.Append([]string{
+				r.Username, r.Uid, r.Shell, r.Status,
+				r.PasswordExpires, r.PasswordInactive, r.AccountExpires,
+			})
+		}
+		table.Render()
+	}
+
+	return nil
+}
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Generate reports about the entities of the system",
+}
+
+var reportExpiryCmd = &cobra.Command{
+	Use:   "expiry",
+	Short: "Report expired and expiring passwords",
+	Long: `Report the accounts with passwords expired, expiring in the given
+window or that never expire, and the expired or expiring accounts.
+
+	$> entities report expiry --within 14d --output csv
+
+To read /etc/shadow requires root permissions.
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "table", "json", "csv":
+		default:
+			return errors.New("Invalid output value. Admits values are: table|json|csv.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		withinStr, _ := cmd.Flags().GetString("within")
+		output, _ := cmd.Flags().GetString("output")
+		includeLocked, _ := cmd.Flags().GetBool("include-locked")
+
+		within, err := parseWindow(withinStr)
+		if err != nil {
+			return err
+		}
+
+		return reportExpiry(filesFromFlags(cmd), within, output, includeLocked)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+	reportCmd.AddCommand(reportExpiryCmd)
+
+	var flags = reportExpiryCmd.Flags()
+	addFilesFlags(flags)
+	flags.String("within", "14d", "Report as expiring what expires in the given window (e.g. 14d, 2w, 72h).")
+	flags.StringP("output", "o", "table", "Output format: table|json|csv")
+	flags.Bool("include-locked", false, "Include the accounts with a locked password.")
+}
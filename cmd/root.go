@@ -14,12 +14,38 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
 )
 
+// Exit code of the commands when changes are pending, with --dry-run, or
+// were made, with --detailed-exitcode
+const exitChanged = 2
+
+// Exit code of check when findings with error severity are left
+const exitFindings = 2
+
+// Exit code of get when the entity is not found
+const exitNotFound = 2
+
+// exitCode is returned by the commands to exit with the code, once their
+// deferred cleanups are done, without printing an error.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+// exitWith returns the exitCode error ending cmd with the code.
+func exitWith(cmd *cobra.Command, code int) error {
+	cmd.SilenceErrors = true
+	cmd.SilenceUsage = true
+	return exitCode(code)
+}
+
 var entityFile string
 
 // rootCmd represents the base command when called without any subcommands
@@ -41,6 +67,10 @@ For example:
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		var code exitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
 		fmt.Println(err)
 		os.Exit(1)
 	}
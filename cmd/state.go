@@ -0,0 +1,129 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	tablewriter "github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+type stateRow struct {
+	StateEntry
+	Status string `json:"status"`
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Show and edit the state of the entities owned by entities",
+	Long: `The state file records the entities created or applied by entities, with the
+spec file they come from, the hash of the line written and when it was written.
+Only the entities in the state are removed by delete and apply --prune.
+
+By default the state is stored in /var/lib/entities/state.json under --root.
+`,
+}
+
+var stateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the entities owned by entities",
+	Long: `List the entities owned by entities with their status: ok, modified
+outside entities, or missing in the identity files.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "table", "json":
+		default:
+			return errors.New("Invalid output value. Admits values are: table|json.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		files := filesFromFlags(cmd)
+
+		st, err := ReadState(files.State)
+		if err != nil {
+			return err
+		}
+
+		rows := []stateRow{}
+		for _, e := range st.List() {
+			status, err := e.Status(files)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, stateRow{StateEntry: e, Status: status})
+		}
+
+		if output == "json" {
+			data, _ := json.Marshal(rows)
+			fmt.Println(string(data))
+			return nil
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetBorders(tablewriter.Border{
+			Left:   true,
+			Top:    true,
+			Right:  true,
+			Bottom: true,
+		})
+		table.SetHeader([]string{"Kind", "Name", "Source", "Updated", "Status"})
+		for _, r := range rows {
+			table.Append([]string{
+				r.Kind, r.Name, r.Source,
+				r.Updated.Format("2006-01-02 15:04:05"), r.Status,
+			})
+		}
+		table.Render()
+
+		return nil
+	},
+}
+
+var stateForgetCmd = &cobra.Command{
+	Use:   "forget <kind> <name>",
+	Short: "Remove an entity from the state without touching it",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st, err := OpenState(filesFromFlags(cmd).State)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		if !st.Forget(args[0], args[1]) {
+			return errors.New("The " + args[0] + " " + args[1] + " is not in the state")
+		}
+
+		return st.Save()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateListCmd)
+	stateCmd.AddCommand(stateForgetCmd)
+
+	addFilesFlags(stateListCmd.Flags())
+	stateListCmd.Flags().StringP("output", "o", "table", "Output format: table|json")
+	addFilesFlags(stateForgetCmd.Flags())
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Synchronise the shadow files with passwd and group",
+	Long: `Sync moves the password hashes of passwd and group in shadow and gshadow,
+setting x in their password field, adds the missing shadow and gshadow entries with
+a locked password and removes the entries of users and groups that don't exist,
+as pwconv and grpconv do.
+
+With --reverse the hashes are moved back in passwd and group and the shadow and
+gshadow entries are removed, as pwunconv and grpunconv do. The password aging is lost.
+
+	$> entities sync --dry-run
+	$> entities sync --reverse
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "text", "json":
+		default:
+			return errors.New("Invalid output value. Admits values are: text|json.")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		reverse, _ := cmd.Flags().GetBool("reverse")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		files := filesFromFlags(cmd)
+
+		sync := (*Transaction).Sync
+		if reverse {
+			sync = (*Transaction).Unsync
+		}
+
+		if dryRun {
+			changes, err := Plan(files, func(t *Transaction) error {
+				_, err := sync(t)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return printPlan(cmd, changes)
+		}
+
+		t := NewTransaction(files)
+		defer t.Close()
+
+		results, err := sync(t)
+		if err != nil {
+			return err
+		}
+		if err := t.Commit(); err != nil {
+			return err
+		}
+
+		printApplyResults(cmd, results)
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	var flags = syncCmd.Flags()
+	flags.Bool("reverse", false, "Move the hashes back in passwd and group and remove the shadow files entries.")
+	flags.Bool("dry-run", false,
+		"Print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	flags.StringP("output", "o", "text", "Output format: text|json")
+	flags.Bool("detailed-exitcode", false,
+		"Exit with 2 when an entry was created, updated or deleted.")
+	addFilesFlags(flags)
+}
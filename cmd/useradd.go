@@ -0,0 +1,292 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func addAccountFlags(flags *pflag.FlagSet) {
+	flags.String("spec-dir", "", "Write the specs of the changed entities in the directory.")
+	flags.Bool("dry-run", false,
+		"Print the changes as a diff without writing them. Exit with 2 if there are changes.")
+	addFilesFlags(flags)
+}
+
+// runAccount runs the account function on a transaction over the identity
+// files and, unless --dry-run is used, commits it and updates the specs of
+// --spec-dir. It returns false if nothing was written.
+func runAccount(cmd *cobra.Command, fn func(t *Transaction) (AccountChanges, error)) (AccountChanges, bool, error) {
+	t := NewTransaction(filesFromFlags(cmd))
+	t.Track = true
+	t.Force, _ = cmd.Flags().GetBool("force")
+	defer t.Close()
+
+	c, err := fn(t)
+	if err != nil {
+		return c, false, err
+	}
+
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		return c, false, printPlan(cmd, t.Changes())
+	}
+
+	if err := t.Commit(); err != nil {
+		return c, false, err
+	}
+
+	if specDir, _ := cmd.Flags().GetString("spec-dir"); specDir != "" {
+		if err := writeSpecs(specDir, c); err != nil {
+			return c, true, errors.New("Error on writing the specs: " + err.Error())
+		}
+	}
+
+	return c, true, nil
+}
+
+// writeSpecs writes the specs of the applied entities in the directory,
+// named as export does, and removes the ones of the deleted entities.
+func writeSpecs(dir string, c AccountChanges) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, e := range c.Deleted {
+		if err := os.Remove(specPath(dir, e)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, e := range c.Specs() {
+		data, err := MarshalEntity(e)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(specPath(dir, e), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupsFromFlag splits the comma separated list of --groups.
+func groupsFromFlag(cmd *cobra.Command) []string {
+	groups := []string{}
+	list, _ := cmd.Flags().GetString("groups")
+	for _, g := range strings.Split(list, ",") {
+		if g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// idFromFlag returns the value of the id flag, or nil if not given.
+func idFromFlag(cmd *cobra.Command, name string) *int {
+	if !cmd.Flags().Changed(name) {
+		return nil
+	}
+	id, _ := cmd.Flags().GetInt(name)
+	return &id
+}
+
+var useraddCmd = &cobra.Command{
+	Use:   "useradd <user>",
+	Short: "Add an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Useradd adds an user and its shadow entry, with a locked password, as
+useradd(8) does. Unless --gid is given, a group named as the user is created,
+with the same id of the user if free.
+
+The uid is allocated from the range of the human users or, with --system, from
+the one of the system accounts. The password can be set with the passwd command.
+
+With --spec-dir the specs of the entities written, <kind>-<name>.yaml, are
+written in the directory too, so that the change can be kept under version
+control and applied elsewhere:
+
+	$> entities useradd -m -G wheel,audio -s /bin/bash --spec-dir specs/ foo
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := UserAddOptions{Uid: idFromFlag(cmd, "uid"), Groups: groupsFromFlag(cmd)}
+		opts.Group, _ = cmd.Flags().GetString("gid")
+		opts.Info, _ = cmd.Flags().GetString("comment")
+		opts.Homedir, _ = cmd.Flags().GetString("home-dir")
+		opts.Shell, _ = cmd.Flags().GetString("shell")
+		opts.System, _ = cmd.Flags().GetBool("system")
+		createHome, _ := cmd.Flags().GetBool("create-home")
+
+		c, written, err := runAccount(cmd, func(t *Transaction) (AccountChanges, error) {
+			return t.UserAdd(args[0], opts)
+		})
+		if err != nil || !written || !createHome {
+			return err
+		}
+
+		root, _ := cmd.Flags().GetString("root")
+		for _, e := range c.Applied {
+			if u, ok := e.(UserPasswd); ok {
+				return CreateHome(root, u.Homedir, u.Uid, u.Gid)
+			}
+		}
+		return nil
+	},
+}
+
+var usermodCmd = &cobra.Command{
+	Use:   "usermod <user>",
+	Short: "Modify an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Usermod changes an user as usermod(8) does. The fields not given are kept.
+
+--groups replaces the supplementary groups of the user, or adds them with --append.
+--move-home moves the content of the home directory to the one given with --home-dir.
+The user is left unchanged if the home directory can't be moved.
+
+With --spec-dir the specs of the entities changed are written in the directory too.
+
+	$> entities usermod -a -G docker --spec-dir specs/ foo
+`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if move, _ := cmd.Flags().GetBool("move-home"); move && !cmd.Flags().Changed("home-dir") {
+			return errors.New("--move-home requires --home-dir")
+		}
+		if appendGroups, _ := cmd.Flags().GetBool("append"); appendGroups && !cmd.Flags().Changed("groups") {
+			return errors.New("--append requires --groups")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := UserModOptions{Uid: idFromFlag(cmd, "uid")}
+		if cmd.Flags().Changed("groups") {
+			opts.Groups = groupsFromFlag(cmd)
+		}
+		opts.Append, _ = cmd.Flags().GetBool("append")
+		opts.Group, _ = cmd.Flags().GetString("gid")
+		opts.Info, _ = cmd.Flags().GetString("comment")
+		opts.Homedir, _ = cmd.Flags().GetString("home-dir")
+		opts.Shell, _ = cmd.Flags().GetString("shell")
+		moveHome, _ := cmd.Flags().GetBool("move-home")
+
+		// The home before the change, to move it
+		var homedir string
+		if moveHome {
+			users, err := ParseUser(filesFromFlags(cmd).Passwd)
+			if err != nil {
+				return err
+			}
+			homedir = users[args[0]].Homedir
+		}
+
+		// The home is moved before committing, so that a failed move leaves
+		// passwd untouched, and moved back if the commit fails.
+		root, _ := cmd.Flags().GetString("root")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		moved := false
+		_, written, err := runAccount(cmd, func(t *Transaction) (AccountChanges, error) {
+			c, err := t.UserMod(args[0], opts)
+			if err != nil || dryRun || !moveHome || homedir == "" || homedir == opts.Homedir {
+				return c, err
+			}
+			if err := MoveHome(root, homedir, opts.Homedir); err != nil {
+				return c, err
+			}
+			moved = true
+			return c, nil
+		})
+		if err != nil && moved && !written {
+			if merr := MoveHome(root, opts.Homedir, homedir); merr != nil {
+				return errors.New(err.Error() + ". Failed moving back the home directory: " + merr.Error())
+			}
+		}
+		return err
+	},
+}
+
+var userdelCmd = &cobra.Command{
+	Use:   "userdel <user>",
+	Short: "Delete an user",
+	Args:  cobra.ExactArgs(1),
+	Long: `Userdel deletes an user and its shadow entry as userdel(8) does. The user is
+removed from the members of its groups, and its primary group is deleted too if
+named as the user and not the primary group of other users.
+
+Only the users owned by entities, recorded in the state file, are deleted unless
+--force is used. With --spec-dir the specs of the deleted entities are removed from
+the directory and the ones of the groups changed are written.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remove, _ := cmd.Flags().GetBool("remove")
+
+		c, written, err := runAccount(cmd, func(t *Transaction) (AccountChanges, error) {
+			return t.UserDel(args[0])
+		})
+		if err != nil || !written || !remove {
+			return err
+		}
+
+		users, err := ParseUser(filesFromFlags(cmd).Passwd)
+		if err != nil {
+			return err
+		}
+		root, _ := cmd.Flags().GetString("root")
+		for _, e := range c.Deleted {
+			if u, ok := e.(UserPasswd); ok {
+				return RemoveHome(root, u, users)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(useraddCmd)
+	rootCmd.AddCommand(usermodCmd)
+	rootCmd.AddCommand(userdelCmd)
+
+	var flags = useraddCmd.Flags()
+	flags.IntP("uid", "u", 0, "Uid of the user. Allocated if not given.")
+	flags.StringP("gid", "g", "", "Name or gid of the primary group. A group named as the user is created if not given.")
+	flags.StringP("groups", "G", "", "Comma separated names or gids of the supplementary groups.")
+	flags.StringP("comment", "c", "", "Info field of the user.")
+	flags.StringP("home-dir", "d", "", "Home directory of the user. Default: /home/<user>.")
+	flags.StringP("shell", "s", "", "Shell of the user. Default: "+DefaultShell+".")
+	flags.BoolP("create-home", "m", false, "Create the home directory with a copy of /etc/skel.")
+	flags.BoolP("system", "r", false, "Allocate the ids in the range of the system accounts.")
+	addAccountFlags(flags)
+
+	flags = usermodCmd.Flags()
+	flags.IntP("uid", "u", 0, "New uid of the user.")
+	flags.StringP("gid", "g", "", "Name or gid of the new primary group.")
+	flags.StringP("groups", "G", "", "Comma separated names or gids of the supplementary groups.")
+	flags.BoolP("append", "a", false, "Add the user to the --groups, without removing it from the other groups.")
+	flags.StringP("comment", "c", "", "New info field of the user.")
+	flags.StringP("home-dir", "d", "", "New home directory of the user.")
+	flags.StringP("shell", "s", "", "New shell of the user.")
+	flags.BoolP("move-home", "m", false, "Move the content of the home directory to the new one.")
+	addAccountFlags(flags)
+
+	flags = userdelCmd.Flags()
+	flags.BoolP("remove", "r", false, "Remove the home directory of the user.")
+	flags.Bool("force", false, "Delete the user even if not owned by entities.")
+	addAccountFlags(flags)
+}
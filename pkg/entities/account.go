@@ -0,0 +1,190 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	NoLoginShell = "/sbin/nologin"
+
+	// Expire value used to disable an account: expired since 1970-01-02.
+	// 0 is avoided because of its special meaning for some tools.
+	disabledExpire = "1"
+)
+
+type LockOptions struct {
+	// Set the account expiration date to 1970-01-02
+	Expire bool
+	// Set the user shell to NoLoginShell
+	NoLogin bool
+}
+
+func getShadow(f Files, username string) (Shadow, error) {
+	current, err := ParseShadow(f.Shadow)
+	if err != nil {
+		return Shadow{}, errors.Wrap(err, "Failed parsing shadow")
+	}
+
+	s, ok := current[username]
+	if !ok {
+		return Shadow{}, errors.New(fmt.Sprintf("User %s is not present in %s", username, f.Shadow))
+	}
+
+	return s, nil
+}
+
+// LockAccount locks the password of the user prefixing it with "!". Locking
+// an already locked password doesn't change it.
+func LockAccount(f Files, username string, opts LockOptions) error {
+	s, err := getShadow(f, username)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(s.Password, "!") {
+		s.Password = "!" + s.Password
+	}
+	if opts.Expire {
+		s.Expire = disabledExpire
+	}
+
+	if err := s.Apply(f.Shadow, false); err != nil {
+		return errors.Wrap(err, "Failed updating shadow")
+	}
+
+	if opts.NoLogin {
+		return setField(f, UserKind, username, 6, NoLoginShell)
+	}
+
+	return nil
+}
+
+// setField rewrites only the field of the line of the entity in the
+// database of kind, keeping the others as they are.
+func setField(f Files, kind, name string, field int, value string) error {
+	t := NewTransaction(f)
+	defer t.Close()
+
+	d, err := t.db(kind)
+	if err != nil {
+		return err
+	}
+	line, ok := d.get(name)
+	if !ok {
+		return errors.New(fmt.Sprintf("User %s is not present in %s", name, f.Path(kind)))
+	}
+
+	fs := strings.Split(line, ":")
+	if len(fs) != databaseFields[kind] {
+		return errors.New(fmt.Sprintf("Invalid %s line of %s", kind, name))
+	}
+	if fs[field] == value {
+		return nil
+	}
+	fs[field] = value
+	d.set(name, strings.Join(fs, ":"))
+
+	return errors.Wrap(t.Commit(), "Failed updating "+f.Path(kind))
+}
+
+// UnlockAccount removes the "!" prefix added by LockAccount, restoring the
+// password the user had before being locked. The expiration date and the
+// shell are not restored.
+func UnlockAccount(f Files, username string) error {
+	s, err := getShadow(f, username)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(s.Password, "!") {
+		return errors.New(fmt.Sprintf("User %s is not locked", username))
+	}
+
+	password := strings.TrimPrefix(s.Password, "!")
+	if password == "" {
+		return errors.New(fmt.Sprintf(
+			"Unlocking user %s would result in a passwordless account", username))
+	}
+
+	// The hash is restored as is, whatever its format
+	return setField(f, ShadowKind, username, 1, password)
+}
+
+// DisableAccount locks the user, expires the account and sets its shell
+// to NoLoginShell.
+func DisableAccount(f Files, username string) error {
+	return LockAccount(f, username, LockOptions{Expire: true, NoLogin: true})
+}
+
+// Credential is the password to set for an user.
+type Credential struct {
+	Username string
+	Password string
+}
+
+type PasswordOptions struct {
+	// The passwords are already hashed with crypt(3) and are written as
+	// they are. Otherwise they are always hashed, whatever they look like.
+	Hashed bool
+	// Policy applied to plaintext passwords
+	Policy *PasswordPolicy
+}
+
+// SetPasswords sets the passwords of the users in the shadow file and
+// updates their last password change. The file is written with a single
+// atomic rewrite and nothing is written if any password can't be set.
+func SetPasswords(f Files, creds []Credential, opts PasswordOptions) error {
+	db, err := openDatabase(f.Shadow, false, 0)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	for _, c := range creds {
+		if c.Password == "" {
+			return errors.New(fmt.Sprintf("Password of %s is empty", c.Username))
+		}
+
+		line, ok := db.get(c.Username)
+		if !ok {
+			return errors.New(fmt.Sprintf("User %s is not present in %s", c.Username, f.Shadow))
+		}
+		_, existing, err := parseLine(line)
+		if err != nil {
+			return errors.Wrap(err, "Failed parsing shadow")
+		}
+
+		// The hashed option alone tells the hashes, of any format, from
+		// the plaintext passwords
+		pwd := c.Password
+		if !opts.Hashed {
+			if err := opts.Policy.checkPlain(c.Username, pwd); err != nil {
+				return err
+			}
+			if pwd, err = encryptPassword(pwd); err != nil {
+				return errors.Wrap(err, "Failed hashing password")
+			}
+		}
+
+		s := Shadow{Username: c.Username, Password: pwd, LastChanged: shadowToday()}
+		db.set(s.Username, s.merge(existing).String())
+	}
+
+	return db.commit()
+}
@@ -0,0 +1,174 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Account", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+
+		s := Shadow{Username: "adm", Password: "$6$salt$hash"}
+		Expect(s.Apply(files.Shadow, false)).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("locks and unlocks restoring the previous hash", func() {
+		Expect(LockAccount(files, "adm", LockOptions{})).Should(BeNil())
+		current, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("!$6$salt$hash"))
+		Expect(current["adm"].LastChanged).To(Equal("9797"))
+
+		// Locking twice doesn't add another prefix
+		Expect(LockAccount(files, "adm", LockOptions{})).Should(BeNil())
+		Expect(UnlockAccount(files, "adm")).Should(BeNil())
+		current, err = ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("$6$salt$hash"))
+
+		Expect(UnlockAccount(files, "adm")).ToNot(BeNil())
+	})
+
+	It("unlocks restoring hashes of any format", func() {
+		// A DES hash, not starting with $
+		s := Shadow{Username: "adm", Password: "!abJnggxhB/yWI"}
+		Expect(s.Apply(files.Shadow, false)).Should(BeNil())
+
+		Expect(UnlockAccount(files, "adm")).Should(BeNil())
+		current, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("abJnggxhB/yWI"))
+
+		Expect(LockAccount(files, "adm", LockOptions{})).Should(BeNil())
+		current, err = ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("!abJnggxhB/yWI"))
+	})
+
+	It("disables an account", func() {
+		Expect(DisableAccount(files, "adm")).Should(BeNil())
+
+		current, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("!$6$salt$hash"))
+		Expect(current["adm"].Expire).To(Equal("1"))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users["adm"].Shell).To(Equal(NoLoginShell))
+		Expect(users["adm"].Uid).To(Equal(3))
+	})
+
+	It("disables an account keeping the other passwd fields", func() {
+		f, err := os.OpenFile(files.Passwd, os.O_APPEND|os.O_WRONLY, 0644)
+		Expect(err).Should(BeNil())
+		_, err = f.WriteString("bob:x:1500:100::/home/bob:/bin/bash\n")
+		Expect(err).Should(BeNil())
+		Expect(f.Close()).Should(BeNil())
+		s := Shadow{Username: "bob", Password: "$6$salt$hash"}
+		Expect(s.Create(files.Shadow)).Should(BeNil())
+
+		Expect(DisableAccount(files, "bob")).Should(BeNil())
+
+		dat, err := os.ReadFile(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(string(dat)).To(ContainSubstring("\nbob:x:1500:100::/home/bob:" + NoLoginShell + "\n"))
+	})
+
+	It("refuses to create a passwordless account", func() {
+		s := Shadow{Username: "lp", Password: "!"}
+		Expect(s.Apply(files.Shadow, false)).Should(BeNil())
+		Expect(UnlockAccount(files, "lp")).ToNot(BeNil())
+	})
+
+	It("sets multiple passwords at once", func() {
+		err := SetPasswords(files, []Credential{
+			{Username: "adm", Password: "foo"},
+			{Username: "lp", Password: "bar"},
+		}, PasswordOptions{})
+		Expect(err).Should(BeNil())
+
+		current, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(PasswordMatch(current["adm"].Password, "foo")).To(BeTrue())
+		Expect(PasswordMatch(current["lp"].Password, "bar")).To(BeTrue())
+		Expect(current["lp"].LastChanged).ToNot(Equal("9797"))
+		Expect(current["lp"].MinimumChanged).To(Equal("0"))
+		Expect(current).To(HaveLen(10))
+	})
+
+	It("doesn't write anything if a password can't be set", func() {
+		before, err := os.ReadFile(files.Shadow)
+		Expect(err).Should(BeNil())
+
+		err = SetPasswords(files, []Credential{
+			{Username: "adm", Password: "foo"},
+			{Username: "missing", Password: "bar"},
+		}, PasswordOptions{})
+		Expect(err).ToNot(BeNil())
+
+		err = SetPasswords(files, []Credential{
+			{Username: "adm", Password: "foo"},
+			{Username: "lp", Password: ""},
+		}, PasswordOptions{})
+		Expect(err).ToNot(BeNil())
+
+		after, err := os.ReadFile(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(after).To(Equal(before))
+
+		err = SetPasswords(files, []Credential{
+			{Username: "adm", Password: "$6$salt$other"},
+		}, PasswordOptions{Hashed: true})
+		Expect(err).Should(BeNil())
+		current, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("$6$salt$other"))
+	})
+
+	It("tells the hashes from the plaintext passwords by the option only", func() {
+		// A DES hash, not starting with $
+		err := SetPasswords(files, []Credential{
+			{Username: "adm", Password: "abJnggxhB/yWI"},
+		}, PasswordOptions{Hashed: true})
+		Expect(err).Should(BeNil())
+
+		err = SetPasswords(files, []Credential{
+			{Username: "lp", Password: "!secret"},
+			{Username: "news", Password: "$secret"},
+		}, PasswordOptions{})
+		Expect(err).Should(BeNil())
+
+		current, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(current["adm"].Password).To(Equal("abJnggxhB/yWI"))
+		Expect(current["lp"].Password).To(HavePrefix("$6$"))
+		Expect(current["news"].Password).To(HavePrefix("$6$"))
+	})
+
+})
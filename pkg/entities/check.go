@@ -0,0 +1,418 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Severity of a Finding
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Number of fields of the lines of each database
+var databaseFields = map[string]int{
+	UserKind:    7,
+	ShadowKind:  9,
+	GroupKind:   4,
+	GShadowKind: 4,
+}
+
+// Finding is an inconsistency found by Check in the database of Kind. Fix
+// describes the action taken with CheckOptions.Fix, if any.
+type Finding struct {
+	Kind     string `json:"kind" yaml:"kind"`
+	Name     string `json:"name" yaml:"name"`
+	Severity string `json:"severity" yaml:"severity"`
+	Message  string `json:"message" yaml:"message"`
+	Fix      string `json:"fix,omitempty" yaml:"fix,omitempty"`
+	Fixed    bool   `json:"fixed,omitempty" yaml:"fixed,omitempty"`
+
+	fix func()
+}
+
+// CheckOptions defines how Check validates the databases.
+type CheckOptions struct {
+	// Root of the home directories and of /etc/shells
+	Root string
+	// Apply the fixes of the findings
+	Fix bool
+}
+
+// Check validates the four identity databases against each other, as pwck
+// and grpck do. With opts.Fix the fixes are written.
+func Check(f Files, opts CheckOptions) ([]Finding, error) {
+	t := NewTransaction(f)
+	defer t.Close()
+
+	findings, err := t.Check(opts)
+	if err != nil || !opts.Fix {
+		return findings, err
+	}
+
+	return findings, t.Commit()
+}
+
+type checker struct {
+	t        *Transaction
+	opts     CheckOptions
+	findings []Finding
+	// Valid lines of each database by name
+	lines map[string]map[string][]string
+	// Names of the valid lines of each database, in file order
+	order map[string][]string
+	// Names of all the lines of each database, also the malformed ones
+	names map[string]map[string]bool
+}
+
+func (c *checker) add(kind, name, severity, msg, fix string, fn func()) {
+	f := Finding{Kind: kind, Name: name, Severity: severity, Message: msg}
+	if fn != nil {
+		f.Fix = fix
+		f.fix = fn
+	}
+	c.findings = append(c.findings, f)
+}
+
+// Check validates the databases of the transaction. With opts.Fix the
+// fixes are applied to the transaction, to be written by Commit.
+func (t *Transaction) Check(opts CheckOptions) ([]Finding, error) {
+	c := &checker{
+		t:     t,
+		opts:  opts,
+		lines: make(map[string]map[string][]string),
+		order: make(map[string][]string),
+		names: make(map[string]map[string]bool),
+	}
+
+	// A missing gshadow file is not checked
+	_, err := os.Stat(t.Files.GShadow)
+	hasGShadow := err == nil
+
+	for _, kind := range []string{UserKind, ShadowKind, GroupKind, GShadowKind} {
+		if kind == GShadowKind && !hasGShadow {
+			continue
+		}
+		if err := c.parse(kind); err != nil {
+			return nil, err
+		}
+	}
+
+	c.checkUsers()
+	c.checkShadows()
+	c.checkGroups(hasGShadow)
+	if hasGShadow {
+		c.checkGShadows()
+		c.checkOrder(GroupKind, GShadowKind)
+	}
+	c.checkOrder(UserKind, ShadowKind)
+
+	if opts.Fix {
+		for i := range c.findings {
+			if c.findings[i].fix != nil {
+				c.findings[i].fix()
+				c.findings[i].Fixed = true
+			}
+		}
+	}
+
+	return c.findings, nil
+}
+
+// parse reports the lines of the database with a wrong number of fields
+// and the duplicate names.
+func (c *checker) parse(kind string) error {
+	d, err := c.t.db(kind)
+	if err != nil {
+		return err
+	}
+
+	lines := make(map[string][]string)
+	order := []string{}
+	names := make(map[string]bool)
+	for i, line := range d.lines {
+		if line == "" {
+			continue
+		}
+		fs := strings.Split(line, ":")
+		names[fs[0]] = true
+		if len(fs) != databaseFields[kind] {
+			c.add(kind, fs[0], SeverityError, fmt.Sprintf(
+				"Line %d has %d fields instead of %d", i+1, len(fs), databaseFields[kind]), "", nil)
+			continue
+		}
+		if _, ok := lines[fs[0]]; ok {
+			c.add(kind, fs[0], SeverityError, fmt.Sprintf("Line %d duplicates the name %s", i+1, fs[0]), "", nil)
+			continue
+		}
+		lines[fs[0]] = fs
+		order = append(order, fs[0])
+	}
+
+	c.lines[kind] = lines
+	c.order[kind] = order
+	c.names[kind] = names
+	return nil
+}
+
+// has reports whether the database of kind has a line with the name, also
+// if the line is malformed.
+func (c *checker) has(kind, name string) bool {
+	return c.names[kind][name]
+}
+
+// checkIDs reports the invalid and the duplicate ids of the passwd or group
+// database.
+func (c *checker) checkIDs(kind, field string) map[int]string {
+	owners := make(map[int]string)
+	for _, name := range c.order[kind] {
+		id, err := strconv.Atoi(c.lines[kind][name][2])
+		if err != nil || id < 0 {
+			c.add(kind, name, SeverityError, fmt.Sprintf("Invalid %s %q", field, c.lines[kind][name][2]), "", nil)
+			continue
+		}
+		if owner, ok := owners[id]; ok {
+			c.add(kind, name, SeverityWarning, fmt.Sprintf("The %s %d is also used by %s", field, id, owner), "", nil)
+			continue
+		}
+		owners[id] = name
+	}
+	return owners
+}
+
+// loginShells returns the shells listed in /etc/shells, or nil if the file
+// can't be read.
+func (c *checker) loginShells() map[string]bool {
+	data, err := os.ReadFile(filepath.Join(c.opts.Root, "/etc/shells"))
+	if err != nil {
+		return nil
+	}
+	shells := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			shells[line] = true
+		}
+	}
+	return shells
+}
+
+// noLoginShell reports whether the shell is used to disable the login,
+// usually not listed in /etc/shells.
+func noLoginShell(shell string) bool {
+	base := filepath.Base(shell)
+	return base == "nologin" || base == "false"
+}
+
+func (c *checker) checkUsers() {
+	c.checkIDs(UserKind, "uid")
+
+	gids := make(map[string]bool)
+	for _, fs := range c.lines[GroupKind] {
+		gids[fs[2]] = true
+	}
+	shells := c.loginShells()
+
+	for _, name := range c.order[UserKind] {
+		fs := c.lines[UserKind][name]
+
+		if _, err := strconv.Atoi(fs[3]); err != nil {
+			c.add(UserKind, name, SeverityError, fmt.Sprintf("Invalid gid %q", fs[3]), "", nil)
+		} else if !gids[fs[3]] {
+			c.add(UserKind, name, SeverityWarning, fmt.Sprintf("The primary group %s doesn't exist", fs[3]), "", nil)
+		}
+
+		if !c.has(ShadowKind, name) {
+			name := name
+			c.add(UserKind, name, SeverityError, "The shadow entry is missing",
+				"add a locked shadow entry", func() {
+					c.set(ShadowKind, name, name+":!:::::::")
+					c.t.sortAs(UserKind, ShadowKind)
+				})
+		}
+
+		if home := fs[5]; home != "" && home != "/nonexistent" {
+			if _, err := os.Stat(filepath.Join(c.opts.Root, home)); os.IsNotExist(err) {
+				c.add(UserKind, name, SeverityWarning, fmt.Sprintf("The home directory %s doesn't exist", home), "", nil)
+			}
+		}
+
+		if shell := fs[6]; shells != nil && shell != "" && !shells[shell] && !noLoginShell(shell) {
+			c.add(UserKind, name, SeverityWarning, fmt.Sprintf("The shell %s is not in /etc/shells", shell), "", nil)
+		}
+	}
+}
+
+func (c *checker) checkShadows() {
+	for _, name := range c.order[ShadowKind] {
+		if !c.has(UserKind, name) {
+			c.addDangling(ShadowKind, name, "user")
+		}
+	}
+}
+
+func (c *checker) checkGroups(hasGShadow bool) {
+	c.checkIDs(GroupKind, "gid")
+
+	for _, name := range c.order[GroupKind] {
+		fs := c.lines[GroupKind][name]
+		c.checkMembers(GroupKind, name, 3, fs[3])
+
+		if hasGShadow && !c.has(GShadowKind, name) {
+			name, members := name, fs[3]
+			c.add(GroupKind, name, SeverityWarning, "The gshadow entry is missing",
+				"add a locked gshadow entry", func() {
+					c.set(GShadowKind, name, name+":!::"+members)
+					c.t.sortAs(GroupKind, GShadowKind)
+				})
+		}
+	}
+}
+
+func (c *checker) checkGShadows() {
+	for _, name := range c.order[GShadowKind] {
+		if !c.has(GroupKind, name) {
+			c.addDangling(GShadowKind, name, "group")
+			continue
+		}
+		if _, ok := c.lines[GroupKind][name]; !ok {
+			continue
+		}
+		fs := c.lines[GShadowKind][name]
+		c.checkMembers(GShadowKind, name, 2, fs[2])
+		c.checkMembers(GShadowKind, name, 3, fs[3])
+	}
+}
+
+// addDangling reports an entry of a shadow database without the entity it
+// belongs to.
+func (c *checker) addDangling(kind, name, owner string) {
+	c.add(kind, name, SeverityError, fmt.Sprintf("The %s %s doesn't exist", owner, name),
+		"remove the entry", func() {
+			if d, err := c.t.db(kind); err == nil {
+				d.remove(name)
+			}
+		})
+}
+
+// checkMembers reports the users of the list in the field of the line that
+// don't exist.
+func (c *checker) checkMembers(kind, name string, field int, list string) {
+	for _, m := range strings.Split(list, ",") {
+		if m == "" {
+			continue
+		}
+		if c.has(UserKind, m) {
+			continue
+		}
+		m := m
+		c.add(kind, name, SeverityWarning, fmt.Sprintf("The member %s doesn't exist", m),
+			"remove the member", func() {
+				c.removeMember(kind, name, field, m)
+			})
+	}
+}
+
+func (c *checker) set(kind, name, line string) {
+	if d, err := c.t.db(kind); err == nil {
+		d.set(name, line)
+	}
+}
+
+func (c *checker) removeMember(kind, name string, field int, member string) {
+	d, err := c.t.db(kind)
+	if err != nil {
+		return
+	}
+	line, ok := d.get(name)
+	if !ok {
+		return
+	}
+
+	fs := strings.Split(line, ":")
+	members := []string{}
+	for _, m := range strings.Split(fs[field], ",") {
+		if m != "" && m != member {
+			members = append(members, m)
+		}
+	}
+	fs[field] = strings.Join(members, ",")
+
+	d.set(name, strings.Join(fs, ":"))
+}
+
+// checkOrder reports if the entries of the shadow database are not in the
+// order of the database they belong to.
+func (c *checker) checkOrder(kind, shadowKind string) {
+	pos := make(map[string]int)
+	for i, name := range c.order[kind] {
+		pos[name] = i
+	}
+
+	last := -1
+	for _, name := range c.order[shadowKind] {
+		i, ok := pos[name]
+		if !ok {
+			continue
+		}
+		if i < last {
+			c.add(shadowKind, "", SeverityWarning,
+				fmt.Sprintf("The entries are not in the order of the %s file", kind),
+				"sort the entries", func() {
+					c.t.sortAs(kind, shadowKind)
+				})
+			return
+		}
+		last = i
+	}
+}
+
+// sortAs sorts the lines of the shadow database as the entries of the
+// database of kind. The entries not in it are kept at the end.
+func (t *Transaction) sortAs(kind, shadowKind string) error {
+	d, err := t.db(kind)
+	if err != nil {
+		return err
+	}
+	sd, err := t.db(shadowKind)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	used := make(map[int]bool)
+	for _, line := range d.lines {
+		if i := sd.find(entityIdentifier(line)); i >= 0 && !used[i] {
+			lines = append(lines, sd.lines[i])
+			used[i] = true
+		}
+	}
+	for i, line := range sd.lines {
+		if !used[i] {
+			lines = append(lines, line)
+		}
+	}
+
+	if strings.Join(lines, "\n") != strings.Join(sd.lines, "\n") {
+		sd.lines = lines
+		sd.changed = true
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Check", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newEmptyRoot()
+		Expect(os.MkdirAll(filepath.Join(root, "home", "foo"), 0755)).Should(BeNil())
+
+		writeFile(filepath.Join(root, "etc", "shells"), "/bin/sh\n")
+		writeFile(files.Passwd, "foo:x:1000:1000::/home/foo:/bin/sh\nbar:x:1001:1000::/home/foo:/bin/sh\n")
+		writeFile(files.Shadow, "foo:!:::::::\nbar:!:::::::\n")
+		writeFile(files.Group, "foo:x:1000:bar\n")
+		writeFile(files.GShadow, "foo:!::bar\n")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("finds nothing in consistent databases", func() {
+		findings, err := Check(files, CheckOptions{Root: root})
+		Expect(err).Should(BeNil())
+		Expect(findings).To(BeEmpty())
+	})
+
+	It("reports the inconsistencies", func() {
+		writeFile(files.Passwd, "foo:x:1000:1000::/home/foo:/bin/zsh\nbar:x:1000:1001::/missing:/sbin/nologin\nbad:x:1\n")
+		writeFile(files.Shadow, "bar:!:::::::\nfoo:!:::::::\nold:!:::::::\n")
+		writeFile(files.Group, "foo:x:1000:bar,gone\n")
+		writeFile(files.GShadow, "foo:!::bar\nfoo:!::\n")
+
+		findings, err := Check(files, CheckOptions{Root: root})
+		Expect(err).Should(BeNil())
+
+		messages := []string{}
+		for _, f := range findings {
+			messages = append(messages, f.Kind+" "+f.Name+" "+f.Severity+": "+f.Message)
+		}
+		Expect(messages).To(Equal([]string{
+			"user bad error: Line 3 has 3 fields instead of 7",
+			"gshadow foo error: Line 2 duplicates the name foo",
+			"user bar warning: The uid 1000 is also used by foo",
+			"user foo warning: The shell /bin/zsh is not in /etc/shells",
+			"user bar warning: The primary group 1001 doesn't exist",
+			"user bar warning: The home directory /missing doesn't exist",
+			"shadow old error: The user old doesn't exist",
+			"group foo warning: The member gone doesn't exist",
+			"shadow  warning: The entries are not in the order of the user file",
+		}))
+	})
+
+	It("fixes the inconsistencies", func() {
+		writeFile(files.Passwd, "foo:x:1000:1000::/home/foo:/bin/sh\nbar:x:1001:1000::/home/foo:/bin/sh\nbaz:x:1002:1000::/home/foo:/bin/sh\n")
+		writeFile(files.Shadow, "baz:!:::::::\nold:!:::::::\nfoo:!:::::::\n")
+		writeFile(files.Group, "foo:x:1000:bar,gone\nweb:x:1001:\n")
+		writeFile(files.GShadow, "foo:!::bar,gone\nold:!::\n")
+
+		findings, err := Check(files, CheckOptions{Root: root, Fix: true})
+		Expect(err).Should(BeNil())
+		for _, f := range findings {
+			Expect(f.Fixed).To(BeTrue())
+		}
+
+		findings, err = Check(files, CheckOptions{Root: root})
+		Expect(err).Should(BeNil())
+		Expect(findings).To(BeEmpty())
+
+		data, err := os.ReadFile(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).To(Equal("foo:!:::::::\nbar:!:::::::\nbaz:!:::::::\n"))
+
+		data, err = os.ReadFile(files.GShadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).To(Equal("foo:!::bar\nweb:!::\n"))
+	})
+
+	It("keeps the malformed lines of the shadow databases", func() {
+		writeFile(files.Shadow, "foo:!:::::::\nbar:$6$salt$hash:18262:0:99999:7\n")
+		writeFile(files.GShadow, "foo:!:bar\n")
+
+		findings, err := Check(files, CheckOptions{Root: root, Fix: true})
+		Expect(err).Should(BeNil())
+
+		messages := []string{}
+		for _, f := range findings {
+			messages = append(messages, f.Kind+" "+f.Name+" "+f.Severity+": "+f.Message)
+			Expect(f.Fix).To(BeEmpty())
+		}
+		Expect(messages).To(Equal([]string{
+			"shadow bar error: Line 2 has 6 fields instead of 9",
+			"gshadow foo error: Line 1 has 3 fields instead of 4",
+		}))
+
+		data, err := os.ReadFile(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).To(Equal("foo:!:::::::\nbar:$6$salt$hash:18262:0:99999:7\n"))
+
+		data, err = os.ReadFile(files.GShadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).To(Equal("foo:!:bar\n"))
+	})
+})
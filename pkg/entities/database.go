@@ -0,0 +1,221 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+	permbits "github.com/phayes/permbits"
+	"github.com/pkg/errors"
+)
+
+// lockFile acquires the lock used by entities to serialize the changes
+// to the given identity file.
+func lockFile(s string) (*flock.Flock, error) {
+	d, err := RetryForDuration()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed getting delay")
+	}
+	i, err := RetryIntervalDuration()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed getting interval")
+	}
+
+	baseName := filepath.Base(s)
+	if _, ok := os.Stat("/run/lock/"); os.IsNotExist(ok) {
+		_ = os.Mkdir("/run/lock/", 0755)
+	}
+	fileLock := flock.New(fmt.Sprintf("/run/lock/%s.lock", baseName))
+
+	lockCtx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	locked, err := fileLock.TryLockContext(lockCtx, i)
+	if err != nil || !locked {
+		fileLock.Close()
+		return nil, errors.Wrap(err, "Failed locking file")
+	}
+
+	return fileLock, nil
+}
+
+func unlockFile(fileLock *flock.Flock) {
+	fileLock.Close()
+	os.Remove(fileLock.Path())
+}
+
+// database is the content of an identity file loaded in memory while
+// holding its lock. Changes are written with a single atomic rewrite.
+type database struct {
+	path    string
+	perm    os.FileMode
+	lines   []string
+	lock    *flock.Flock
+	changed bool
+	// Content of the file when it was opened
+	original []byte
+}
+
+// openDatabase locks and reads the identity file. If missing is true a
+// non existing file is handled as empty and created with perm on commit.
+func openDatabase(path string, missing bool, perm os.FileMode) (*database, error) {
+	fileLock, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &database{path: path, perm: perm, lock: fileLock, lines: []string{}}
+
+	input, err := os.ReadFile(path)
+	if err != nil && !(missing && os.IsNotExist(err)) {
+		db.close()
+		return nil, errors.Wrap(err, "Could not read input file")
+	}
+	if err == nil {
+		permissions, err := permbits.Stat(path)
+		if err != nil {
+			db.close()
+			return nil, errors.Wrap(err, "Failed getting permissions")
+		}
+		db.perm = os.FileMode(permissions)
+		db.original = input
+
+		content := strings.TrimSuffix(string(input), "\n")
+		if content != "" {
+			db.lines = strings.Split(content, "\n")
+		}
+	}
+
+	return db, nil
+}
+
+func (d *database) find(name string) int {
+	for i, line := range d.lines {
+		if entityIdentifier(line) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *database) get(name string) (string, bool) {
+	if i := d.find(name); i >= 0 {
+		return d.lines[i], true
+	}
+	return "", false
+}
+
+// idOwner returns the name of the entity using the id, for the databases
+// having the id as third field.
+func (d *database) idOwner(id int) (string, bool) {
+	sid := strconv.Itoa(id)
+	for _, line := range d.lines {
+		fs := strings.Split(line, ":")
+		if len(fs) > 2 && fs[2] == sid {
+			return fs[0], true
+		}
+	}
+	return "", false
+}
+
+// set replaces the line of the entity or appends it if not present.
+func (d *database) set(name, line string) {
+	i := d.find(name)
+	if i < 0 {
+		d.lines = append(d.lines, line)
+		d.changed = true
+	} else if d.lines[i] != line {
+		d.lines[i] = line
+		d.changed = true
+	}
+}
+
+func (d *database) remove(name string) bool {
+	i := d.find(name)
+	if i < 0 {
+		return false
+	}
+	d.lines = append(d.lines[:i], d.lines[i+1:]...)
+	d.changed = true
+	return true
+}
+
+func (d *database) content() []byte {
+	if len(d.lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(d.lines, "\n") + "\n")
+}
+
+// commit writes the changes, if any, replacing the file atomically.
+func (d *database) commit() error {
+	if !d.changed {
+		return nil
+	}
+
+	if err := writeFileAtomic(d.path, d.content(), d.perm); err != nil {
+		return err
+	}
+	d.changed = false
+	return nil
+}
+
+func (d *database) close() {
+	if d.lock != nil {
+		unlockFile(d.lock)
+		d.lock = nil
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory of
+// path and renames it over path, keeping the owner of the original file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return errors.Wrap(err, "Could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Could not write")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Could not write")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Could not write")
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return errors.Wrap(err, "Failed setting permissions")
+	}
+	if info, err := os.Stat(path); err == nil {
+		if err := copyOwner(info, tmp.Name()); err != nil {
+			return errors.Wrap(err, "Failed setting owner")
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "Could not write")
+	}
+
+	return nil
+}
@@ -0,0 +1,351 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// DiffDirection selects the differences reported by Diff.
+type DiffDirection string
+
+const (
+	// Entities of the specs missing or different in the system
+	DiffForward DiffDirection = "forward"
+	// Entities of the system missing in the specs
+	DiffReverse DiffDirection = "reverse"
+	DiffBoth    DiffDirection = "both"
+)
+
+// DiffOptions defines how Diff compares the entities.
+type DiffOptions struct {
+	// Fields not compared, named as in the specs (e.g. "shell")
+	IgnoreFields []string
+	// DiffForward if empty
+	Direction DiffDirection
+	// Selects the entities of the system reported by DiffReverse and DiffBoth
+	Filter EntitiesFilter
+	// Don't verify the passwords of the specs against the current ones
+	SkipPasswords bool
+	// State used to check the ids allocated to the dynamic entities. They
+	// are not checked if nil.
+	State *State
+}
+
+func (o DiffOptions) ignored(field string) bool {
+	if field == "password" && o.SkipPasswords {
+		return true
+	}
+	for _, f := range o.IgnoreFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldDifference is a field with a different value in the system and in
+// the specs. Password values are never reported: Redacted is set instead.
+type FieldDifference struct {
+	Field    string `json:"field" yaml:"field"`
+	Current  string `json:"current,omitempty" yaml:"current,omitempty"`
+	Desired  string `json:"desired,omitempty" yaml:"desired,omitempty"`
+	Redacted bool   `json:"redacted,omitempty" yaml:"redacted,omitempty"`
+}
+
+func (f FieldDifference) String() string {
+	if f.Redacted {
+		return f.Field + " changed"
+	}
+	return fmt.Sprintf("%s: %q -> %q", f.Field, f.Current, f.Desired)
+}
+
+// Difference is an entity of the specs missing or different in the
+// system, or an unmanaged entity of the system. The entities are encoded
+// with the passwords redacted and decoded by Kind.
+type Difference struct {
+	OriginalEntity Entity            `json:"originalEntity,omitempty" yaml:"originalEntity,omitempty"`
+	TargetEntity   Entity            `json:"targetEntity,omitempty" yaml:"targetEntity,omitempty"`
+	Kind           string            `json:"kind" yaml:"kind"`
+	Name           string            `json:"name" yaml:"name"`
+	Descr          string            `json:"descr,omitempty" yaml:"descr,omitempty"`
+	Missing        bool              `json:"missing" yaml:"missing"`
+	Unmanaged      bool              `json:"unmanaged,omitempty" yaml:"unmanaged,omitempty"`
+	Fields         []FieldDifference `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+type differenceJSON struct {
+	OriginalEntity json.RawMessage   `json:"originalEntity,omitempty"`
+	TargetEntity   json.RawMessage   `json:"targetEntity,omitempty"`
+	Kind           string            `json:"kind"`
+	Name           string            `json:"name"`
+	Descr          string            `json:"descr,omitempty"`
+	Missing        bool              `json:"missing"`
+	Unmanaged      bool              `json:"unmanaged,omitempty"`
+	Fields         []FieldDifference `json:"fields,omitempty"`
+}
+
+func (d Difference) MarshalJSON() ([]byte, error) {
+	v := differenceJSON{
+		Kind:      d.Kind,
+		Name:      d.Name,
+		Descr:     d.Descr,
+		Missing:   d.Missing,
+		Unmanaged: d.Unmanaged,
+		Fields:    d.Fields,
+	}
+
+	var err error
+	if d.OriginalEntity != nil {
+		if v.OriginalEntity, err = json.Marshal(RedactEntity(d.OriginalEntity)); err != nil {
+			return nil, err
+		}
+	}
+	if d.TargetEntity != nil {
+		if v.TargetEntity, err = json.Marshal(RedactEntity(d.TargetEntity)); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+func (d *Difference) UnmarshalJSON(data []byte) error {
+	var v differenceJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*d = Difference{
+		Kind:      v.Kind,
+		Name:      v.Name,
+		Descr:     v.Descr,
+		Missing:   v.Missing,
+		Unmanaged: v.Unmanaged,
+		Fields:    v.Fields,
+	}
+
+	p := &Parser{}
+	var err error
+	if len(v.OriginalEntity) > 0 {
+		if d.OriginalEntity, err = p.ReadEntityFromJSON(v.Kind, v.OriginalEntity); err != nil {
+			return err
+		}
+	}
+	if len(v.TargetEntity) > 0 {
+		if d.TargetEntity, err = p.ReadEntityFromJSON(v.Kind, v.TargetEntity); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadFiles adds the entities of the identity files.
+func (s *EntitiesStore) LoadFiles(f Files) error {
+	mUsers, err := ParseUser(f.Passwd)
+	if err != nil {
+		return err
+	}
+
+	mGroups, err := ParseGroup(f.Group)
+	if err != nil {
+		return err
+	}
+
+	mShadows, err := ParseShadow(f.Shadow)
+	if err != nil {
+		return err
+	}
+
+	mGShadows, err := ParseGShadow(f.GShadow)
+	if err != nil {
+		return err
+	}
+
+	s.Users = mUsers
+	s.Groups = mGroups
+	s.Shadows = mShadows
+	s.GShadows = mGShadows
+
+	return nil
+}
+
+type fieldsDiff struct {
+	opts   DiffOptions
+	fields []FieldDifference
+}
+
+func (d *fieldsDiff) add(name, current, desired string) {
+	if current != desired && !d.opts.ignored(name) {
+		d.fields = append(d.fields, FieldDifference{Field: name, Current: current, Desired: desired})
+	}
+}
+
+// password adds a redacted difference if the password of the specs doesn't
+// match the current one.
+func (d *fieldsDiff) password(current, desired string) {
+	if !PasswordMatch(current, desired) && !d.opts.ignored("password") {
+		d.fields = append(d.fields, FieldDifference{Field: "password", Redacted: true})
+	}
+}
+
+// dynamicID adds a difference if the id allocated to a dynamic entity is
+// not the one recorded in the state.
+func (d *fieldsDiff) dynamicID(field, kind, name string, current int) {
+	if d.opts.State == nil {
+		return
+	}
+	if e, ok := d.opts.State.Get(kind, name); ok && e.ID != nil {
+		d.add(field, strconv.Itoa(current), strconv.Itoa(*e.ID))
+	}
+}
+
+// groupName returns the name of the group with the gid, or the gid itself
+// if there isn't one.
+func groupName(s *EntitiesStore, gid int) string {
+	for _, name := range s.names(GroupKind) {
+		if g := s.Groups[name]; g.Gid != nil && *g.Gid == gid {
+			return name
+		}
+	}
+	return strconv.Itoa(gid)
+}
+
+func gidString(gid *int) string {
+	if gid == nil {
+		return ""
+	}
+	return strconv.Itoa(*gid)
+}
+
+// Diff compares the entities of the system in current with the desired
+// ones, usually loaded from specs.
+func Diff(current, desired *EntitiesStore, opts DiffOptions) []Difference {
+	differences := []Difference{}
+
+	if opts.Direction != DiffReverse {
+		for _, e := range desired.Entities() {
+			if d, ok := diffEntity(current, e, opts); ok {
+				differences = append(differences, d)
+			}
+		}
+	}
+
+	if opts.Direction == DiffReverse || opts.Direction == DiffBoth {
+		for _, e := range desired.Unmanaged(current, opts.Filter) {
+			differences = append(differences, Difference{
+				OriginalEntity: e,
+				Unmanaged:      true,
+				Kind:           e.GetKind(),
+				Name:           EntityName(e),
+				Descr:          fmt.Sprintf("The %s %s is not in the specs.", e.GetKind(), EntityName(e)),
+			})
+		}
+	}
+
+	return differences
+}
+
+func diffEntity(current *EntitiesStore, e Entity, opts DiffOptions) (Difference, bool) {
+	name := EntityName(e)
+	d := Difference{
+		TargetEntity: e,
+		Kind:         e.GetKind(),
+		Name:         name,
+	}
+
+	fields := &fieldsDiff{opts: opts}
+	present := true
+
+	switch v := e.(type) {
+	case UserPasswd:
+		var c UserPasswd
+		if c, present = current.GetUser(name); !present {
+			break
+		}
+		d.OriginalEntity = c
+		if v.Uid >= 0 {
+			fields.add("uid", strconv.Itoa(c.Uid), strconv.Itoa(v.Uid))
+		} else {
+			fields.dynamicID("uid", UserKind, name, c.Uid)
+		}
+		if v.Group == "" {
+			fields.add("gid", strconv.Itoa(c.Gid), strconv.Itoa(v.Gid))
+		} else if g, ok := current.Groups[v.Group]; ok && g.Gid != nil {
+			fields.add("gid", strconv.Itoa(c.Gid), strconv.Itoa(*g.Gid))
+		} else {
+			// The group of the spec is missing in the system
+			fields.add("group", groupName(current, c.Gid), v.Group)
+		}
+		fields.add("homedir", c.Homedir, v.Homedir)
+		fields.add("shell", c.Shell, v.Shell)
+	case Group:
+		var c Group
+		if c, present = current.GetGroup(name); !present {
+			break
+		}
+		d.OriginalEntity = c
+		fields.password(c.Password, v.Password)
+		if v.Gid != nil && *v.Gid >= 0 {
+			fields.add("gid", gidString(c.Gid), gidString(v.Gid))
+		} else if v.Gid != nil && c.Gid != nil {
+			fields.dynamicID("gid", GroupKind, name, *c.Gid)
+		}
+		fields.add("users", c.Users, v.Users)
+	case Shadow:
+		var c Shadow
+		if c, present = current.GetShadow(name); !present {
+			break
+		}
+		d.OriginalEntity = c
+		// An empty password keeps the current one
+		switch v.Password {
+		case "":
+		case ShadowUnset:
+			fields.password(c.Password, "")
+		default:
+			fields.password(c.Password, v.Password)
+		}
+		fields.add("minimum_changed", c.MinimumChanged, v.MinimumChanged)
+		fields.add("maximum_changed", c.MaximumChanged, v.MaximumChanged)
+		fields.add("warn", c.Warn, v.Warn)
+		fields.add("inactive", c.Inactive, v.Inactive)
+		fields.add("expire", c.Expire, v.Expire)
+	case GShadow:
+		var c GShadow
+		if c, present = current.GetGShadow(name); !present {
+			break
+		}
+		d.OriginalEntity = c
+		fields.password(c.Password, v.Password)
+		fields.add("administrators", c.Administrators, v.Administrators)
+		fields.add("members", c.Members, v.Members)
+	}
+
+	if !present {
+		d.Missing = true
+		d.Descr = fmt.Sprintf("The %s %s is not present.", d.Kind, name)
+		return d, true
+	}
+	if len(fields.fields) > 0 {
+		d.Fields = fields.fields
+		d.Descr = fmt.Sprintf("The %s %s has difference.", d.Kind, name)
+		return d, true
+	}
+
+	return d, false
+}
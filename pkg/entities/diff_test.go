@@ -0,0 +1,149 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Diff", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("reports nothing after apply", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		_, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		current := NewEntitiesStore()
+		Expect(current.LoadFiles(files)).Should(BeNil())
+		Expect(Diff(current, store, DiffOptions{})).To(BeEmpty())
+	})
+
+	It("verifies passwords, group references and dynamic ids", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		_, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		st, err := ReadState(files.State)
+		Expect(err).Should(BeNil())
+		entry, ok := st.Get(UserKind, "web")
+		Expect(ok).To(BeTrue())
+		Expect(entry.ID).ToNot(BeNil())
+
+		current := NewEntitiesStore()
+		Expect(current.LoadFiles(files)).Should(BeNil())
+		opts := DiffOptions{State: st}
+		Expect(Diff(current, store, opts)).To(BeEmpty())
+
+		u := current.Users["web"]
+		u.Uid = *entry.ID + 1
+		current.Users["web"] = u
+		s := current.Shadows["web"]
+		s.Password = "!"
+		current.Shadows["web"] = s
+		delete(current.Groups, "webgrp")
+
+		diffs := Diff(current, store, opts)
+		Expect(len(diffs)).To(Equal(3))
+		Expect(diffs[0].Kind).To(Equal(GroupKind))
+		Expect(diffs[0].Missing).To(BeTrue())
+		Expect(diffs[1].Kind).To(Equal(UserKind))
+		Expect(diffs[1].Fields).To(Equal([]FieldDifference{
+			{Field: "uid", Current: strconv.Itoa(*entry.ID + 1), Desired: strconv.Itoa(*entry.ID)},
+			{Field: "group", Current: strconv.Itoa(u.Gid), Desired: "webgrp"},
+		}))
+		Expect(diffs[2].Kind).To(Equal(ShadowKind))
+		Expect(diffs[2].Fields).To(Equal([]FieldDifference{{Field: "password", Redacted: true}}))
+	})
+
+	It("reports missing and different entities", func() {
+		current := NewEntitiesStore()
+		current.AddUser(UserPasswd{Username: "foo", Uid: 1000, Gid: 1000, Homedir: "/home/foo", Shell: "/bin/sh"})
+		current.AddUser(UserPasswd{Username: "old", Uid: 1001})
+
+		desired := NewEntitiesStore()
+		desired.AddUser(UserPasswd{Username: "foo", Uid: 1000, Gid: 1000, Homedir: "/home/foo", Shell: "/bin/bash"})
+		desired.AddUser(UserPasswd{Username: "bar", Uid: -1})
+
+		diffs := Diff(current, desired, DiffOptions{})
+		Expect(len(diffs)).To(Equal(2))
+		Expect(diffs[0].Name).To(Equal("bar"))
+		Expect(diffs[0].Missing).To(BeTrue())
+		Expect(diffs[1].Name).To(Equal("foo"))
+		Expect(diffs[1].Fields).To(Equal([]FieldDifference{
+			{Field: "shell", Current: "/bin/sh", Desired: "/bin/bash"},
+		}))
+
+		Expect(len(Diff(current, desired, DiffOptions{IgnoreFields: []string{"shell"}}))).To(Equal(1))
+
+		diffs = Diff(current, desired, DiffOptions{Direction: DiffReverse})
+		Expect(len(diffs)).To(Equal(1))
+		Expect(diffs[0].Name).To(Equal("old"))
+		Expect(diffs[0].Unmanaged).To(BeTrue())
+
+		Expect(len(Diff(current, desired, DiffOptions{Direction: DiffBoth}))).To(Equal(3))
+	})
+
+	It("verifies passwords unless skipped", func() {
+		current := NewEntitiesStore()
+		current.AddGShadow(GShadow{Name: "foo", Password: "!"})
+
+		desired := NewEntitiesStore()
+		desired.AddGShadow(GShadow{Name: "foo", Password: "secret"})
+
+		diffs := Diff(current, desired, DiffOptions{})
+		Expect(len(diffs)).To(Equal(1))
+		Expect(diffs[0].Fields).To(Equal([]FieldDifference{{Field: "password", Redacted: true}}))
+
+		Expect(Diff(current, desired, DiffOptions{SkipPasswords: true})).To(BeEmpty())
+	})
+
+	It("encodes and decodes differences", func() {
+		d := Difference{
+			TargetEntity: GShadow{Name: "foo", Password: "$6$salt$hash"},
+			Kind:         GShadowKind,
+			Name:         "foo",
+			Missing:      true,
+		}
+
+		data, err := json.Marshal(d)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).ToNot(ContainSubstring("$6$salt$hash"))
+
+		var decoded Difference
+		Expect(json.Unmarshal(data, &decoded)).Should(BeNil())
+		Expect(decoded.TargetEntity).To(Equal(GShadow{Name: "foo", Password: RedactedPassword}))
+		Expect(decoded.Missing).To(BeTrue())
+	})
+})
@@ -28,11 +28,18 @@ const (
 	ENTITY_ENV_DEF_DYNAMIC_RANGE = "ENTITY_DYNAMIC_RANGE"
 	ENTITY_ENV_DEF_DELAY         = "ENTITY_DEFAULT_DELAY"
 	ENTITY_ENV_DEF_INTERVAL      = "ENTITY_DEFAULT_INTERVAL"
+	ENTITY_ENV_DEF_POLICY        = "ENTITY_PASSWORD_POLICY"
+	ENTITY_ENV_DEF_STATE         = "ENTITY_DEFAULT_STATE"
 
 	// https://systemd.io/UIDS-GIDS/#summary
 	// https://systemd.io/UIDS-GIDS/#special-distribution-uid-ranges
 	HumanIDMin = 1000
 	HumanIDMax = 60000
+
+	// Range of the ids of the system accounts, as SYS_UID_MIN and
+	// SYS_UID_MAX of login.defs
+	SystemIDMin = 101
+	SystemIDMax = 999
 )
 
 // Entity represent something that needs to be applied to a file
@@ -0,0 +1,146 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type ExpiryStatus string
+
+const (
+	ExpiryOK ExpiryStatus = "ok"
+	// The password never expires
+	ExpiryNever ExpiryStatus = "never"
+	// The password or the account expire in the given window
+	ExpiryExpiring ExpiryStatus = "expiring"
+	// The password is expired and must be changed at the next login
+	ExpiryExpired ExpiryStatus = "expired"
+	// The password is expired since more than the inactivity period
+	ExpiryInactive ExpiryStatus = "inactive"
+	// The account is expired
+	ExpiryAccountExpired ExpiryStatus = "account_expired"
+
+	// Maximum password age used by the distributions to disable the expiration
+	neverExpireDays = 99999
+)
+
+// Expiry describes the expiration dates of an user computed from the shadow
+// fields. Nil dates never happen.
+type Expiry struct {
+	Username         string
+	PasswordExpires  *time.Time
+	PasswordInactive *time.Time
+	AccountExpires   *time.Time
+	Status           ExpiryStatus
+}
+
+func shadowDays(field, value string) (int64, bool, error) {
+	if value == "" {
+		return 0, false, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "Invalid "+field+" value")
+	}
+	return i, true, nil
+}
+
+func daysToTime(days int64) *time.Time {
+	t := time.Unix(days*24*60*60, 0).UTC()
+	return &t
+}
+
+// ShadowDate converts a shadow field expressed in days since 1970-01-01 to
+// a human readable date. The days are counted in UTC, so the date is in
+// UTC whatever the local time zone.
+func ShadowDate(days string) (string, error) {
+	if days == "" {
+		return "", nil
+	}
+
+	i, err := strconv.ParseInt(days, 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	return daysToTime(i).Format("2006-01-02T15:04:05Z"), nil
+}
+
+// ShadowExpiry computes the expiration dates of a shadow entry. The status
+// is evaluated at now, reporting as expiring what expires within the
+// given window.
+func ShadowExpiry(s Shadow, now time.Time, within time.Duration) (Expiry, error) {
+	ans := Expiry{Username: s.Username, Status: ExpiryOK}
+
+	lastChanged, hasLastChanged, err := shadowDays("last_changed", s.LastChanged)
+	if err != nil {
+		return ans, err
+	}
+	maxDays, hasMax, err := shadowDays("maximum_changed", s.MaximumChanged)
+	if err != nil {
+		return ans, err
+	}
+	inactive, hasInactive, err := shadowDays("inactive", s.Inactive)
+	if err != nil {
+		return ans, err
+	}
+	expire, hasExpire, err := shadowDays("expire", s.Expire)
+	if err != nil {
+		return ans, err
+	}
+
+	today := now.Unix() / 24 / 60 / 60
+	limit := now.Add(within).Unix() / 24 / 60 / 60
+
+	// Days are compared in the days since 1970-01-01 unit used by the file
+	var pwdExpires int64
+	pwdNeverExpires := true
+	if hasLastChanged && lastChanged == 0 {
+		// The user must change the password at the next login
+		pwdExpires = 0
+		pwdNeverExpires = false
+	} else if hasLastChanged && hasMax && maxDays < neverExpireDays {
+		pwdExpires = lastChanged + maxDays
+		pwdNeverExpires = false
+	}
+
+	if !pwdNeverExpires {
+		ans.PasswordExpires = daysToTime(pwdExpires)
+		if hasInactive {
+			ans.PasswordInactive = daysToTime(pwdExpires + inactive)
+		}
+	}
+	if hasExpire {
+		ans.AccountExpires = daysToTime(expire)
+	}
+
+	switch {
+	case hasExpire && expire <= today:
+		ans.Status = ExpiryAccountExpired
+	case !pwdNeverExpires && hasInactive && pwdExpires+inactive <= today:
+		ans.Status = ExpiryInactive
+	case !pwdNeverExpires && pwdExpires <= today:
+		ans.Status = ExpiryExpired
+	case (!pwdNeverExpires && pwdExpires <= limit) || (hasExpire && expire <= limit):
+		ans.Status = ExpiryExpiring
+	case pwdNeverExpires:
+		ans.Status = ExpiryNever
+	}
+
+	return ans, nil
+}
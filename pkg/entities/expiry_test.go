@@ -0,0 +1,83 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"time"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Expiry", func() {
+	// 2020-01-01 is the day 18262 since 1970-01-01
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	within := 14 * 24 * time.Hour
+
+	status := func(s Shadow) ExpiryStatus {
+		e, err := ShadowExpiry(s, now, within)
+		Expect(err).Should(BeNil())
+		return e.Status
+	}
+
+	It("computes the expiration dates", func() {
+		e, err := ShadowExpiry(Shadow{
+			Username:       "foo",
+			LastChanged:    "18262",
+			MaximumChanged: "30",
+			Inactive:       "5",
+			Expire:         "18300",
+		}, now, within)
+		Expect(err).Should(BeNil())
+		Expect(e.Status).To(Equal(ExpiryOK))
+		Expect(e.PasswordExpires.Format("2006-01-02")).To(Equal("2020-01-31"))
+		Expect(e.PasswordInactive.Format("2006-01-02")).To(Equal("2020-02-05"))
+		Expect(e.AccountExpires.Format("2006-01-02")).To(Equal("2020-02-08"))
+	})
+
+	It("computes the status", func() {
+		Expect(status(Shadow{LastChanged: "18262"})).To(Equal(ExpiryNever))
+		Expect(status(Shadow{LastChanged: "18262", MaximumChanged: "99999"})).To(Equal(ExpiryNever))
+		Expect(status(Shadow{LastChanged: "18262", MaximumChanged: "10"})).To(Equal(ExpiryExpiring))
+		Expect(status(Shadow{LastChanged: "18262", MaximumChanged: "90", Expire: "18270"})).To(Equal(ExpiryExpiring))
+		Expect(status(Shadow{LastChanged: "18200", MaximumChanged: "30"})).To(Equal(ExpiryExpired))
+		Expect(status(Shadow{LastChanged: "0"})).To(Equal(ExpiryExpired))
+		Expect(status(Shadow{LastChanged: "18200", MaximumChanged: "30", Inactive: "7"})).To(Equal(ExpiryInactive))
+		Expect(status(Shadow{LastChanged: "18262", Expire: "1"})).To(Equal(ExpiryAccountExpired))
+	})
+
+	It("fails on invalid fields", func() {
+		_, err := ShadowExpiry(Shadow{LastChanged: "now"}, now, within)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("formats the shadow days in UTC", func() {
+		local := time.Local
+		defer func() { time.Local = local }()
+		time.Local = time.FixedZone("UTC-5", -5*60*60)
+
+		date, err := ShadowDate("18262")
+		Expect(err).Should(BeNil())
+		Expect(date).To(Equal("2020-01-01T00:00:00Z"))
+
+		date, err = ShadowDate("")
+		Expect(err).Should(BeNil())
+		Expect(date).To(Equal(""))
+
+		_, err = ShadowDate("never")
+		Expect(err).ShouldNot(BeNil())
+	})
+})
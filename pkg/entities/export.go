@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ExportOptions selects the entities returned by Export.
+type ExportOptions struct {
+	// Kinds of the entities, all if empty
+	Kinds []string
+	// Selects the entities by name and id, as for prune
+	Filter EntitiesFilter
+	// Keep the password hashes. Without them the specs keep the current
+	// passwords when applied, except gshadow ones that are locked.
+	WithPasswords bool
+}
+
+func (o ExportOptions) kind(kind string) bool {
+	if len(o.Kinds) == 0 {
+		return true
+	}
+	for _, k := range o.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Export returns the entities of the store selected by the options, in the
+// order they have to be applied.
+func (s *EntitiesStore) Export(opts ExportOptions) []Entity {
+	ans := []Entity{}
+	for _, kind := range transactionKinds {
+		if !opts.kind(kind) {
+			continue
+		}
+		for _, name := range s.names(kind) {
+			if !opts.Filter.MatchEntity(s, kind, name) {
+				continue
+			}
+			e := s.get(kind, name)
+			if !opts.WithPasswords {
+				e = withoutPassword(e)
+			}
+			ans = append(ans, e)
+		}
+	}
+	return ans
+}
+
+// withoutPassword replaces the password hash of the entity. The shadow and
+// gshadow entries are locked, as the ones added by Sync, so that the specs
+// never create an account without password.
+func withoutPassword(e Entity) Entity {
+	p := entityPassword(e)
+	if v := strings.TrimLeft(p, "!"); v == "" || v == "x" || v == "*" {
+		return e
+	}
+
+	switch e.GetKind() {
+	case UserKind:
+		return withPassword(e, "x")
+	case ShadowKind, GShadowKind:
+		return withPassword(e, "!")
+	}
+	return withPassword(e, "")
+}
+
+// MarshalEntity returns the YAML spec of the entity, with its kind.
+func MarshalEntity(e Entity) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(e); err != nil {
+		return nil, errors.Wrap(err, "Failed encoding entity")
+	}
+
+	node.Content = append([]*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "kind"},
+		{Kind: yaml.ScalarNode, Value: e.GetKind()},
+	}, node.Content...)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, errors.Wrap(err, "Failed encoding entity")
+	}
+	if err := enc.Close(); err != nil {
+		return nil, errors.Wrap(err, "Failed encoding entity")
+	}
+
+	return buf.Bytes(), nil
+}
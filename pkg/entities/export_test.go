@@ -0,0 +1,139 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+		files.State = ""
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("selects the entities and hides the hashes", func() {
+		current := NewEntitiesStore()
+		current.AddUser(UserPasswd{Username: "foo", Password: "x", Uid: 1000})
+		current.AddUser(UserPasswd{Username: "root", Password: "x", Uid: 0})
+		current.AddShadow(Shadow{Username: "foo", Password: "$6$salt$hash"})
+		current.AddShadow(Shadow{Username: "root", Password: "!$6$salt$hash"})
+		current.AddGShadow(GShadow{Name: "foo", Password: "$6$salt$hash"})
+
+		entities := current.Export(ExportOptions{
+			Filter: EntitiesFilter{Exclude: regexp.MustCompile("^root$")},
+		})
+		Expect(entities).To(Equal([]Entity{
+			GShadow{Name: "foo", Password: "!"},
+			UserPasswd{Username: "foo", Password: "x", Uid: 1000},
+			Shadow{Username: "foo", Password: "!"},
+		}))
+
+		entities = current.Export(ExportOptions{
+			Kinds:         []string{ShadowKind},
+			Filter:        EntitiesFilter{MinID: 1000},
+			WithPasswords: true,
+		})
+		Expect(entities).To(Equal([]Entity{Shadow{Username: "foo", Password: "$6$salt$hash"}}))
+	})
+
+	It("writes specs applied without changes", func() {
+		// An user with an empty info
+		f, err := os.OpenFile(files.Passwd, os.O_APPEND|os.O_WRONLY, 0644)
+		Expect(err).Should(BeNil())
+		_, err = f.WriteString("bob:x:1500:100::/home/bob:/bin/sh\n")
+		Expect(err).Should(BeNil())
+		Expect(f.Close()).Should(BeNil())
+		passwd, err := os.ReadFile(files.Passwd)
+		Expect(err).Should(BeNil())
+
+		current := NewEntitiesStore()
+		Expect(current.LoadFiles(files)).Should(BeNil())
+
+		data := []byte{}
+		for _, e := range current.Export(ExportOptions{WithPasswords: true}) {
+			spec, err := MarshalEntity(e)
+			Expect(err).Should(BeNil())
+			data = append(data, []byte("---\n")...)
+			data = append(data, spec...)
+		}
+		spec := filepath.Join(root, "specs.yaml")
+		Expect(os.WriteFile(spec, data, 0600)).Should(BeNil())
+
+		store := NewEntitiesStore()
+		Expect(store.LoadFile(spec)).Should(BeNil())
+		Expect(len(store.Users)).To(Equal(len(current.Users)))
+		Expect(len(store.Shadows)).To(Equal(len(current.Shadows)))
+
+		results, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+		for _, r := range results {
+			Expect(r.Action).To(Equal(ActionUnchanged), r.Kind+" "+r.Name)
+		}
+
+		data, err = os.ReadFile(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).To(Equal(string(passwd)))
+	})
+
+	It("writes specs creating locked accounts without the hashes", func() {
+		current := NewEntitiesStore()
+		Expect(current.LoadFiles(files)).Should(BeNil())
+
+		store := NewEntitiesStore()
+		for _, e := range current.Export(ExportOptions{}) {
+			Expect(store.AddEntity(e)).Should(BeNil())
+		}
+		Expect(store.Shadows).ToNot(BeEmpty())
+
+		empty, emptyFiles := newEmptyRoot()
+		defer os.RemoveAll(empty)
+		for _, path := range []string{emptyFiles.Passwd, emptyFiles.Shadow, emptyFiles.Group, emptyFiles.GShadow} {
+			writeFile(path, "")
+		}
+		_, err := store.Apply(emptyFiles, false)
+		Expect(err).Should(BeNil())
+
+		shadows, err := ParseShadow(emptyFiles.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(shadows).To(HaveLen(len(store.Shadows)))
+		for name, s := range shadows {
+			Expect(s.Password).ToNot(BeEmpty(), name)
+			Expect(s.Password).ToNot(HavePrefix("$"), name)
+		}
+	})
+
+	It("marshals the kind first", func() {
+		gid := 100
+		data, err := MarshalEntity(Group{Name: "foo", Password: "x", Gid: &gid})
+		Expect(err).Should(BeNil())
+		Expect(string(data)).To(Equal("kind: group\ngroup_name: foo\npassword: x\ngid: 100\nusers: \"\"\n"))
+	})
+})
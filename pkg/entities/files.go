@@ -0,0 +1,82 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"path/filepath"
+)
+
+// Files defines the paths of the identity databases an operation works on.
+type Files struct {
+	Passwd  string
+	Shadow  string
+	Group   string
+	GShadow string
+	// State file of the entities owned by entities. Empty disables it.
+	State string
+}
+
+// NewFiles returns the default paths of the identity databases. When root
+// is not empty the paths are relative to it.
+func NewFiles(root string) Files {
+	return Files{
+		Passwd:  filepath.Join(root, UserDefault("")),
+		Shadow:  filepath.Join(root, ShadowDefault("")),
+		Group:   filepath.Join(root, GroupsDefault("")),
+		GShadow: filepath.Join(root, GShadowDefault("")),
+		State:   filepath.Join(root, StateDefault("")),
+	}
+}
+
+// Path returns the path of the database of the kind.
+func (f Files) Path(kind string) string {
+	switch kind {
+	case UserKind:
+		return f.Passwd
+	case ShadowKind:
+		return f.Shadow
+	case GroupKind:
+		return f.Group
+	case GShadowKind:
+		return f.GShadow
+	}
+	return ""
+}
+
+// SetPath sets the path of the database of the kind.
+func (f *Files) SetPath(kind, path string) {
+	switch kind {
+	case UserKind:
+		f.Passwd = path
+	case ShadowKind:
+		f.Shadow = path
+	case GroupKind:
+		f.Group = path
+	case GShadowKind:
+		f.GShadow = path
+	}
+}
+
+// EntityFiles returns the default identity files, using s for the database
+// of the kind of the entity as the Entity methods do. The state is disabled
+// when s is not empty.
+func EntityFiles(e Entity, s string) Files {
+	f := NewFiles("")
+	if s != "" {
+		f.SetPath(e.GetKind(), s)
+		f.State = ""
+	}
+
+	return f
+}
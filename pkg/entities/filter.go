@@ -0,0 +1,292 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EntitiesFilter selects the entities of the identity files considered as
+// unmanaged when missing in the specs. Shadow and gshadow entries have the
+// id of the user or the group with the same name, or -1 if there isn't one.
+type EntitiesFilter struct {
+	// Regular expressions matched against the entity name
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+	// Range of the uid or gid. A MaxID of 0 means no upper limit.
+	MinID int
+	MaxID int
+	// When defined only the entities owned by entities are selected
+	State *State
+	// When defined only the entities matching the query are selected
+	Query *Query
+}
+
+// Match reports whether the entity with the given name and id is selected.
+// Entities without an id are selected only if no range is defined.
+func (f EntitiesFilter) Match(name string, id int) bool {
+	if f.Include != nil && !f.Include.MatchString(name) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(name) {
+		return false
+	}
+	if f.MinID <= 0 && f.MaxID <= 0 {
+		return true
+	}
+	return id >= 0 && id >= f.MinID && (f.MaxID <= 0 || id <= f.MaxID)
+}
+
+// MatchEntity reports whether the entity of the kind with the name in the
+// store is selected, by name, id and query.
+func (f EntitiesFilter) MatchEntity(s *EntitiesStore, kind, name string) bool {
+	if !f.Match(name, s.id(kind, name)) {
+		return false
+	}
+	return f.Query == nil || f.Query.Match(s, kind, name)
+}
+
+// Order used to remove entities: the reverse of transactionKinds
+var pruneKinds = []string{ShadowKind, UserKind, GShadowKind, GroupKind}
+
+// Has reports whether the store has an entity of the kind with the name.
+func (s *EntitiesStore) Has(kind, name string) bool {
+	var ok bool
+	switch kind {
+	case UserKind:
+		_, ok = s.Users[name]
+	case GroupKind:
+		_, ok = s.Groups[name]
+	case ShadowKind:
+		_, ok = s.Shadows[name]
+	case GShadowKind:
+		_, ok = s.GShadows[name]
+	}
+	return ok
+}
+
+func (s *EntitiesStore) get(kind, name string) Entity {
+	switch kind {
+	case UserKind:
+		return s.Users[name]
+	case GroupKind:
+		return s.Groups[name]
+	case ShadowKind:
+		return s.Shadows[name]
+	case GShadowKind:
+		return s.GShadows[name]
+	}
+	return nil
+}
+
+// Find returns the entity of the kind with the given name or, if there is
+// none, with the given numeric uid or gid. Shadow and gshadow entries are
+// found by the id of their user or group.
+func (s *EntitiesStore) Find(kind, key string) (Entity, bool) {
+	if s.Has(kind, key) {
+		return s.get(kind, key), true
+	}
+
+	id, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, false
+	}
+	for _, name := range s.names(kind) {
+		if s.id(kind, name) == id {
+			return s.get(kind, name), true
+		}
+	}
+	return nil, false
+}
+
+func (s *EntitiesStore) names(kind string) []string {
+	names := []string{}
+	switch kind {
+	case UserKind:
+		for name := range s.Users {
+			names = append(names, name)
+		}
+	case GroupKind:
+		for name := range s.Groups {
+			names = append(names, name)
+		}
+	case ShadowKind:
+		for name := range s.Shadows {
+			names = append(names, name)
+		}
+	case GShadowKind:
+		for name := range s.GShadows {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// id returns the uid or gid of the entity, as described in EntitiesFilter.
+func (s *EntitiesStore) id(kind, name string) int {
+	switch kind {
+	case UserKind, ShadowKind:
+		if u, ok := s.Users[name]; ok {
+			return u.Uid
+		}
+	case GroupKind, GShadowKind:
+		if g, ok := s.Groups[name]; ok && g.Gid != nil {
+			return *g.Gid
+		}
+	}
+	return -1
+}
+
+// Unmanaged returns the entities of current missing in the store and
+// selected by the filter, in the order they have to be removed.
+func (s *EntitiesStore) Unmanaged(current *EntitiesStore, filter EntitiesFilter) []Entity {
+	ans := []Entity{}
+	for _, kind := range pruneKinds {
+		for _, name := range current.names(kind) {
+			if !s.Has(kind, name) && filter.MatchEntity(current, kind, name) &&
+				(filter.State == nil || filter.State.Owns(kind, name)) {
+				ans = append(ans, current.get(kind, name))
+			}
+		}
+	}
+	return ans
+}
+
+// ids returns the third field, the uid or the gid, of the lines of the
+// database of the kind by name.
+func (t *Transaction) ids(kind string) (map[string]int, error) {
+	d, err := t.db(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	ans := make(map[string]int)
+	for _, line := range d.lines {
+		fs := strings.Split(line, ":")
+		if len(fs) < 3 {
+			continue
+		}
+		if id, err := strconv.Atoi(fs[2]); err == nil {
+			ans[fs[0]] = id
+		}
+	}
+	return ans, nil
+}
+
+// Prune removes the entities of the databases missing in the store and
+// selected by the filter. Only the entities owned by entities are removed.
+// Without a state nothing is removed, unless Force is set to remove all the
+// entities selected.
+func (t *Transaction) Prune(s *EntitiesStore, filter EntitiesFilter) ([]ApplyResult, error) {
+	st, err := t.State()
+	if err != nil {
+		return nil, err
+	}
+	if st == nil && !t.Force {
+		return nil, errors.New("The entities owned can't be known without a state")
+	}
+
+	uids, err := t.ids(UserKind)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := t.ids(GroupKind)
+	if err != nil {
+		return nil, err
+	}
+
+	// The queries need the joined entities
+	var current *EntitiesStore
+	if filter.Query != nil {
+		if current, err = t.store(); err != nil {
+			return nil, err
+		}
+	}
+
+	results := []ApplyResult{}
+	for _, kind := range pruneKinds {
+		d, err := t.db(kind)
+		if err != nil {
+			return nil, err
+		}
+
+		ids := uids
+		if kind == GroupKind || kind == GShadowKind {
+			ids = gids
+		}
+
+		names := []string{}
+		for _, line := range d.lines {
+			name := entityIdentifier(line)
+			if name == "" || s.Has(kind, name) {
+				continue
+			}
+			id, ok := ids[name]
+			if !ok {
+				id = -1
+			}
+			if filter.Match(name, id) && (st == nil || st.Owns(kind, name)) &&
+				(current == nil || filter.Query.Match(current, kind, name)) {
+				names = append(names, name)
+			}
+		}
+
+		for _, name := range names {
+			d.remove(name)
+			t.touch(kind, name)
+			results = append(results, ApplyResult{Kind: kind, Name: name, Action: ActionDeleted})
+		}
+	}
+
+	return results, nil
+}
+
+// store returns the entities of the databases of the transaction. Lines
+// that can't be parsed are skipped.
+func (t *Transaction) store() (*EntitiesStore, error) {
+	s := NewEntitiesStore()
+	for _, kind := range transactionKinds {
+		d, err := t.db(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range d.lines {
+			switch kind {
+			case UserKind:
+				if name, u, err := parseUserLine(line); err == nil {
+					s.Users[name] = u
+				}
+			case GroupKind:
+				if name, g, err := parseGroupLine(line); err == nil {
+					s.Groups[name] = g
+				}
+			case ShadowKind:
+				if name, sh, err := parseLine(line); err == nil {
+					s.Shadows[name] = sh
+				}
+			case GShadowKind:
+				if name, gs, err := parseGShadowLine(line); err == nil {
+					s.GShadows[name] = gs
+				}
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"regexp"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EntitiesFilter", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("matches names and ids", func() {
+		f := EntitiesFilter{
+			Exclude: regexp.MustCompile("^nobody$"),
+			MinID:   1000,
+			MaxID:   60000,
+		}
+		Expect(f.Match("foo", 1000)).To(BeTrue())
+		Expect(f.Match("foo", 999)).To(BeFalse())
+		Expect(f.Match("foo", 65534)).To(BeFalse())
+		Expect(f.Match("nobody", 1001)).To(BeFalse())
+		Expect(f.Match("foo", -1)).To(BeFalse())
+
+		Expect(EntitiesFilter{}.Match("foo", -1)).To(BeTrue())
+		Expect(EntitiesFilter{Include: regexp.MustCompile("^f")}.Match("bar", 0)).To(BeFalse())
+	})
+
+	It("finds the entities missing in the specs", func() {
+		current := NewEntitiesStore()
+		current.AddUser(UserPasswd{Username: "root", Uid: 0})
+		current.AddUser(UserPasswd{Username: "old", Uid: 1500})
+		current.AddShadow(Shadow{Username: "old"})
+		current.AddUser(UserPasswd{Username: "web", Uid: 1000})
+
+		specs := NewEntitiesStore()
+		specs.AddUser(UserPasswd{Username: "web", Uid: -1})
+
+		unmanaged := specs.Unmanaged(current, EntitiesFilter{MinID: 1000})
+		Expect(unmanaged).To(Equal([]Entity{
+			Shadow{Username: "old"},
+			UserPasswd{Username: "old", Uid: 1500},
+		}))
+	})
+
+	It("finds the entities by name or id", func() {
+		gid := 1000
+		current := NewEntitiesStore()
+		current.AddUser(UserPasswd{Username: "foo", Uid: 1000})
+		current.AddShadow(Shadow{Username: "foo"})
+		current.AddGroup(Group{Name: "web", Gid: &gid})
+
+		e, ok := current.Find(UserKind, "foo")
+		Expect(ok).To(BeTrue())
+		Expect(e).To(Equal(UserPasswd{Username: "foo", Uid: 1000}))
+
+		e, ok = current.Find(ShadowKind, "1000")
+		Expect(ok).To(BeTrue())
+		Expect(e).To(Equal(Shadow{Username: "foo"}))
+
+		e, ok = current.Find(GroupKind, "1000")
+		Expect(ok).To(BeTrue())
+		Expect(EntityName(e)).To(Equal("web"))
+
+		_, ok = current.Find(UserKind, "1001")
+		Expect(ok).To(BeFalse())
+		_, ok = current.Find(GShadowKind, "web")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("prunes the entities missing in the specs", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		_, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		delete(store.Users, "web")
+		delete(store.Shadows, "web")
+
+		results, err := store.ApplyWithOptions(files, ApplyOptions{
+			Prune:       true,
+			PruneFilter: EntitiesFilter{MinID: 1000},
+		})
+		Expect(err).Should(BeNil())
+		Expect(results).To(ContainElements(
+			ApplyResult{Kind: ShadowKind, Name: "web", Action: ActionDeleted},
+			ApplyResult{Kind: UserKind, Name: "web", Action: ActionDeleted},
+		))
+		Expect(results).To(HaveLen(4))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users).ToNot(HaveKey("web"))
+		Expect(users).To(HaveKey("root"))
+
+		shadows, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(shadows).ToNot(HaveKey("web"))
+		Expect(shadows).To(HaveKey("lp"))
+	})
+})
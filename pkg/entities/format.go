@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Orders of the entries used by Format
+const (
+	FormatByID   = "id"
+	FormatByName = "name"
+)
+
+// FormatOptions defines how Format sorts the entries.
+type FormatOptions struct {
+	// FormatByID if empty
+	SortBy string
+}
+
+// Format normalises the identity files: exact duplicate lines, empty lines
+// and carriage returns are removed, the users and the groups are sorted
+// with the system accounts first and the shadow files follow their order,
+// as pwck -s and grpck -s do.
+func Format(f Files, opts FormatOptions) error {
+	t := NewTransaction(f)
+	defer t.Close()
+
+	if err := t.Format(opts); err != nil {
+		return err
+	}
+
+	return t.Commit()
+}
+
+// Format is the Format function on the databases of the transaction.
+func (t *Transaction) Format(opts FormatOptions) error {
+	for _, kinds := range [][2]string{{UserKind, ShadowKind}, {GroupKind, GShadowKind}} {
+		d, err := t.db(kinds[0])
+		if err != nil {
+			return err
+		}
+		sd, err := t.db(kinds[1])
+		if err != nil {
+			return err
+		}
+
+		d.normalize()
+		sd.normalize()
+		sortEntries(d.lines, opts.SortBy)
+
+		if err := t.sortAs(kinds[0], kinds[1]); err != nil {
+			return err
+		}
+
+		d.updateChanged()
+		sd.updateChanged()
+	}
+
+	return nil
+}
+
+// normalize removes the carriage returns, the empty lines and the exact
+// duplicate lines.
+func (d *database) normalize() {
+	lines := []string{}
+	seen := make(map[string]bool)
+	for _, line := range d.lines {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || seen[line] {
+			continue
+		}
+		seen[line] = true
+		lines = append(lines, line)
+	}
+	d.lines = lines
+}
+
+// updateChanged marks the database as changed if the content differs from
+// the one read, also only for the trailing newline.
+func (d *database) updateChanged() {
+	if !bytes.Equal(d.content(), d.original) {
+		d.changed = true
+	}
+}
+
+// systemID reports whether the id is of a system account, outside the
+// range of the human users.
+func systemID(id int) bool {
+	return id < HumanIDMin || id > HumanIDMax
+}
+
+// sortEntries sorts the passwd or group lines with the system accounts
+// first, by id or by name. Lines without a valid id are kept at the end.
+func sortEntries(lines []string, by string) {
+	type entry struct {
+		name  string
+		id    int
+		valid bool
+	}
+
+	entries := make(map[string]entry, len(lines))
+	for _, line := range lines {
+		fs := strings.Split(line, ":")
+		e := entry{name: fs[0]}
+		if len(fs) > 2 {
+			if id, err := strconv.Atoi(fs[2]); err == nil {
+				e.id, e.valid = id, true
+			}
+		}
+		entries[line] = e
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		a, b := entries[lines[i]], entries[lines[j]]
+		if a.valid != b.valid {
+			return a.valid
+		}
+		if !a.valid {
+			return false
+		}
+		if systemID(a.id) != systemID(b.id) {
+			return systemID(a.id)
+		}
+		if by == FormatByName && a.name != b.name {
+			return a.name < b.name
+		}
+		if a.id != b.id {
+			return a.id < b.id
+		}
+		return a.name < b.name
+	})
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Format", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newEmptyRoot()
+		writeFile(files.Passwd, "foo:x:1000:1000::/:/bin/sh\r\nroot:x:0:0::/:/bin/sh\n")
+		writeFile(files.Shadow, "foo:!:::::::\nroot:!:::::::\n")
+		writeFile(files.Group, "web:x:1001:\nfoo:x:1000:\n\nnobody:x:65534:\nfoo:x:1000:\nroot:x:0:")
+		writeFile(files.GShadow, "foo:!::\nroot:!::\nweb:!::\nnobody:!::\n")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("sorts by id with the system accounts first", func() {
+		Expect(Format(files, FormatOptions{})).Should(BeNil())
+
+		Expect(readFile(files.Passwd)).To(Equal("root:x:0:0::/:/bin/sh\nfoo:x:1000:1000::/:/bin/sh\n"))
+		Expect(readFile(files.Shadow)).To(Equal("root:!:::::::\nfoo:!:::::::\n"))
+		Expect(readFile(files.Group)).To(Equal("root:x:0:\nnobody:x:65534:\nfoo:x:1000:\nweb:x:1001:\n"))
+		Expect(readFile(files.GShadow)).To(Equal("root:!::\nnobody:!::\nfoo:!::\nweb:!::\n"))
+
+		changes, err := Plan(files, func(t *Transaction) error {
+			return t.Format(FormatOptions{})
+		})
+		Expect(err).Should(BeNil())
+		Expect(changes).To(BeEmpty())
+	})
+
+	It("sorts by name", func() {
+		Expect(Format(files, FormatOptions{SortBy: FormatByName})).Should(BeNil())
+
+		Expect(readFile(files.Group)).To(Equal("nobody:x:65534:\nroot:x:0:\nfoo:x:1000:\nweb:x:1001:\n"))
+	})
+})
@@ -84,8 +84,19 @@ func parseGroupLine(line string) (string, Group, error) {
 	return fs[0], Group{fs[0], fs[1], &gid, fs[3]}, nil
 }
 
+// freeID returns the lowest id of the human range not in use.
+func freeID(used map[int]struct{}) (int, error) {
+	for i := HumanIDMin; i <= HumanIDMax; i++ {
+		if _, found := used[i]; found {
+			continue // id in use, skip it
+		}
+		return i, nil // found a free one, stop here
+	}
+
+	return -1, errors.New("no available id in range")
+}
+
 func groupGetFreeGid(path string) (int, error) {
-	result := -1
 	allGroups, _ := ParseGroup(path)
 	groupSet := make(map[int]struct{})
 
@@ -93,40 +104,48 @@ func groupGetFreeGid(path string) (int, error) {
 		groupSet[*groupID.Gid] = struct{}{}
 	}
 
-	for i := HumanIDMin; i <= HumanIDMax; i++ {
-		if _, found := groupSet[i]; found {
-			continue // uid in use, skip it
-		}
-		result = i // found a free one, stop here
-		break
-	}
-
-	if result == -1 {
-		return result, errors.New("no available gid in range")
+	gid, err := freeID(groupSet)
+	if err != nil {
+		return gid, errors.New("no available gid in range")
 	}
 
-	return result, nil
+	return gid, nil
 }
 
 type Group struct {
-	Name     string `yaml:"group_name"`
-	Password string `yaml:"password"`
-	Gid      *int   `yaml:"gid"`
-	Users    string `yaml:"users"`
+	Name     string `yaml:"group_name" json:"group_name"`
+	Password string `yaml:"password" json:"password"`
+	Gid      *int   `yaml:"gid" json:"gid"`
+	Users    string `yaml:"users" json:"users"`
 }
 
 func (u Group) GetKind() string { return GroupKind }
 
 func (u Group) prepare(s string) (Group, error) {
+	return u.prepareWith(func() (int, error) { return groupGetFreeGid(s) })
+}
+
+// prepareWith resolves the dynamic fields of the group getting the free
+// gids from the given function.
+func (u Group) prepareWith(freeGid func() (int, error)) (Group, error) {
 	if u.Gid != nil && *u.Gid < 0 {
 		// POST: dynamic group
-		gid, err := groupGetFreeGid(s)
+		gid, err := freeGid()
 		if err != nil {
 			return u, err
 		}
 		u.Gid = &gid
 	}
 
+	// The "x" placeholder means the password is stored in /etc/gshadow
+	if u.Password != "x" {
+		pwd, err := hashPassword(u.Password)
+		if err != nil {
+			return u, errors.Wrap(err, "Failed hashing group password")
+		}
+		u.Password = pwd
+	}
+
 	return u, nil
 }
 
@@ -274,120 +293,35 @@ func Unique(strSlice []string) []string {
 	return list
 }
 
-func (u Group) Apply(s string, safe bool) error {
-	if u.Name == "" {
-		return errors.New("Empty group name")
-	}
-
-	s = GroupsDefault(s)
-
-	u, err := u.prepare(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed entity preparation")
-	}
-
-	current, err := ParseGroup(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed parsing passwd")
-	}
-	permissions, err := permbits.Stat(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
-	}
-
-	if safe && u.Gid != nil {
-		// Avoid this check if the gid is not
-		// present. For example for the specs where
-		// we add users to a group.
-
-		mGids := make(map[int]*Group)
-
-		// Create gids to check gid mismatch
-		// Maybe could be done always.
-		for _, e := range current {
-			mGids[*e.Gid] = &e
-		}
-
-		if e, present := mGids[*u.Gid]; present {
-			if e.Name != u.Name {
-				return errors.Wrap(err,
-					fmt.Sprintf("Gid %d is already used on group %s",
-						*u.Gid, u.Name))
-			}
+// merge combines the group with the existing one: the users are merged,
+// the gid and the password are kept if not defined or in safe mode.
+func (u Group) merge(g Group, safe bool) Group {
+	// Merge the groups, don't override the whole user.
+	if len(g.Users) > 0 {
+		currentUsers := strings.Split(g.Users, ",")
+		if u.Users != "" {
+			currentUsers = append(currentUsers, strings.Split(u.Users, ",")...)
 		}
+		u.Users = strings.Join(Unique(currentUsers), ",")
 	}
 
-	if _, ok := current[u.Name]; ok {
-		d, err := RetryForDuration()
-		if err != nil {
-			return errors.Wrap(err, "Failed getting delay")
-		}
-
-		baseName := filepath.Base(s)
-		if _, ok := os.Stat("/run/lock/"); os.IsNotExist(ok) {
-			_ = os.Mkdir("/run/lock/", 0755)
+	if !safe {
+		if len(u.Password) == 0 {
+			u.Password = g.Password
 		}
-		fileLock := flock.New(fmt.Sprintf("/run/lock/%s.lock", baseName))
-		defer os.Remove(fileLock.Path())
-		defer fileLock.Close()
-		lockCtx, cancel := context.WithTimeout(context.Background(), d)
-		defer cancel()
-		i, err := RetryIntervalDuration()
-		if err != nil {
-			return errors.Wrap(err, "Failed getting interval")
-		}
-		locked, err := fileLock.TryLockContext(lockCtx, i)
-		if err != nil || !locked {
-			return errors.Wrap(err, "Failed locking file")
-		}
-
-		input, err := os.ReadFile(s)
-		if err != nil {
-			return errors.Wrap(err, "Could not read input file")
-		}
-
-		lines := strings.Split(string(input), "\n")
-
-		for i, line := range lines {
-			if entityIdentifier(line) == u.Name {
-				// Merge the groups, don't override the whole user.
-				_, g, err := parseGroupLine(lines[i])
-				if err != nil {
-					return errors.Wrap(err, "Failed parsing current group")
-				}
-				if len(g.Users) > 0 {
-					currentUsers := strings.Split(g.Users, ",")
-					if u.Users != "" {
-						currentUsers = append(currentUsers, strings.Split(u.Users, ",")...)
-					}
-					u.Users = strings.Join(Unique(currentUsers), ",")
-				}
-
-				if !safe {
-					if len(u.Password) == 0 {
-						u.Password = g.Password
-					}
-					if u.Gid == nil {
-						u.Gid = g.Gid
-					}
-				} else {
-					// Maintain existing group id and password
-					u.Gid = g.Gid
-					u.Password = g.Password
-				}
-
-				lines[i] = u.String()
-			}
+		if u.Gid == nil {
+			u.Gid = g.Gid
 		}
-		output := strings.Join(lines, "\n")
-		err = os.WriteFile(s, []byte(output), os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not write")
-		}
-
 	} else {
-		return u.Create(s)
+		// Maintain existing group id and password
+		u.Gid = g.Gid
+		u.Password = g.Password
 	}
 
-	return nil
+	return u
+}
+
+func (u Group) Apply(s string, safe bool) error {
+	_, err := ApplyEntity(u, s, safe)
+	return err
 }
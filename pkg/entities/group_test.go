@@ -50,10 +50,9 @@ var _ = Describe("Group", func() {
 
 			dat, err := os.ReadFile(tmpFile.Name())
 			Expect(err).Should(BeNil())
-			Expect(string(dat)).To(Equal(
-				`nm-openconnect:x:979:
-sddm:xx:1:one,two,tree
-openvpn:x:977:
+			Expect(string(dat)).To(MatchRegexp(`(?m)^sddm:\$6\$[^:]*:1:one,two,tree$`))
+			Expect(string(dat)).To(ContainSubstring(
+				`openvpn:x:977:
 nm-openvpn:x:976:
 minetest:x:975:
 abrt:x:974:
@@ -82,17 +81,10 @@ ntp:x:123:
 
 			dat, err := os.ReadFile(tmpFile.Name())
 			Expect(err).Should(BeNil())
-			Expect(string(dat)).To(Equal(
-				`nm-openconnect:x:979:
-sddm:x:978:
-openvpn:x:977:
-nm-openvpn:x:976:
-minetest:x:975:
-abrt:x:974:
-geoclue:x:973:
-ntp:x:123:
-foo:xx:1:one,two,tree
-`))
+			Expect(string(dat)).To(MatchRegexp(`ntp:x:123:\nfoo:\$6\$[^:]*:1:one,two,tree\n$`))
+			current, err := ParseGroup(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			Expect(PasswordMatch(current["foo"].Password, "xx")).To(BeTrue())
 
 			entity, err = p.ReadEntity("../../testing/fixtures/group/group_add.yaml")
 			Expect(err).Should(BeNil())
@@ -102,17 +94,7 @@ foo:xx:1:one,two,tree
 
 			dat, err = os.ReadFile(tmpFile.Name())
 			Expect(err).Should(BeNil())
-			Expect(string(dat)).To(Equal(
-				`nm-openconnect:x:979:
-sddm:x:978:
-openvpn:x:977:
-nm-openvpn:x:976:
-minetest:x:975:
-abrt:x:974:
-geoclue:x:973:
-ntp:x:123:
-foo:xx:1:one,two,tree,four
-`))
+			Expect(string(dat)).To(MatchRegexp(`ntp:x:123:\nfoo:\$6\$[^:]*:1:one,two,tree,four\n$`))
 
 			entity.Delete(tmpFile.Name())
 			dat, err = os.ReadFile(tmpFile.Name())
@@ -129,6 +111,28 @@ ntp:x:123:
 `))
 		})
 
+		It("Keeps the gshadow placeholder", func() {
+			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
+			if err != nil {
+				fmt.Println("Cannot create temporary file", err)
+			}
+
+			// cleaning up by removing the file
+			defer os.Remove(tmpFile.Name())
+
+			_, err = copy("../../testing/fixtures/group/group", tmpFile.Name())
+			Expect(err).Should(BeNil())
+
+			gid := 1
+			g := Group{Name: "foo", Password: "x", Gid: &gid}
+			err = g.Apply(tmpFile.Name(), false)
+			Expect(err).Should(BeNil())
+
+			dat, err := os.ReadFile(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(ContainSubstring("foo:x:1:\n"))
+		})
+
 		It("works with locks", func() {
 			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
 			if err != nil {
@@ -76,10 +76,10 @@ func parseGShadowLine(line string) (string, GShadow, error) {
 }
 
 type GShadow struct {
-	Name           string `yaml:"name"`
-	Password       string `yaml:"password"`
-	Administrators string `yaml:"administrators"`
-	Members        string `yaml:"members"`
+	Name           string `yaml:"name" json:"name"`
+	Password       string `yaml:"password" json:"password"`
+	Administrators string `yaml:"administrators" json:"administrators"`
+	Members        string `yaml:"members" json:"members"`
 }
 
 func (u GShadow) GetKind() string { return GShadowKind }
@@ -93,6 +93,16 @@ func (u GShadow) String() string {
 	}, ":")
 }
 
+func (u GShadow) prepare() (GShadow, error) {
+	pwd, err := hashPassword(u.Password)
+	if err != nil {
+		return u, errors.Wrap(err, "Failed hashing group password")
+	}
+	u.Password = pwd
+
+	return u, nil
+}
+
 func (u GShadow) Delete(s string) error {
 	s = GShadowDefault(s)
 	input, err := os.ReadFile(s)
@@ -118,7 +128,12 @@ func (u GShadow) Create(s string) error {
 
 	s = GShadowDefault(s)
 
-	_, err := os.Stat(s)
+	u, err := u.prepare()
+	if err != nil {
+		return errors.Wrap(err, "Failed entity preparation")
+	}
+
+	_, err = os.Stat(s)
 	if err == nil {
 		current, err := ParseGShadow(s)
 		if err != nil {
@@ -153,47 +168,6 @@ func (u GShadow) Create(s string) error {
 }
 
 func (u GShadow) Apply(s string, safe bool) error {
-	s = GShadowDefault(s)
-
-	_, err := os.Stat(s)
-	if err == nil {
-		current, err := ParseGShadow(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
-
-		if _, ok := current[u.Name]; ok {
-			input, err := os.ReadFile(s)
-			if err != nil {
-				return errors.Wrap(err, "Could not read input file")
-			}
-
-			lines := strings.Split(string(input), "\n")
-
-			for i, line := range lines {
-				if entityIdentifier(line) == u.Name && !safe {
-					lines[i] = u.String()
-				}
-			}
-			output := strings.Join(lines, "\n")
-			err = os.WriteFile(s, []byte(output), os.FileMode(permissions))
-			if err != nil {
-				return errors.Wrap(err, "Could not write")
-			}
-
-		} else {
-			// Add it
-			return u.Create(s)
-		}
-	} else if os.IsNotExist(err) {
-		return u.Create(s)
-	} else {
-		return errors.Wrap(err, "Could not stat file")
-	}
-
-	return nil
+	_, err := ApplyEntity(u, s, safe)
+	return err
 }
@@ -0,0 +1,166 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// homePath returns the path of the home directory under root. Relative
+// homes and / are refused.
+func homePath(root, homedir string) (string, error) {
+	if !filepath.IsAbs(homedir) || filepath.Clean(homedir) == "/" {
+		return "", errors.New("Invalid home directory " + homedir)
+	}
+	return filepath.Join(root, homedir), nil
+}
+
+// chown changes the owner of the path when running as root.
+func chown(path string, uid, gid int) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// CreateHome creates the home directory under root, with a copy of the
+// /etc/skel directory of root, owned by the user, as useradd -m does. An
+// existing home is left untouched and reported as an error.
+func CreateHome(root, homedir string, uid, gid int) error {
+	home, err := homePath(root, homedir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(home); err == nil {
+		return errors.New("The home directory " + homedir + " already exists, the files of skel are not copied")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(home), 0755); err != nil {
+		return errors.Wrap(err, "Failed creating the parent of the home directory")
+	}
+	if err := os.Mkdir(home, 0700); err != nil {
+		return errors.Wrap(err, "Failed creating the home directory")
+	}
+	if err := chown(home, uid, gid); err != nil {
+		return errors.Wrap(err, "Failed changing the owner of the home directory")
+	}
+
+	skel := filepath.Join(root, "/etc/skel")
+	if _, err := os.Stat(skel); err != nil {
+		return nil
+	}
+
+	return filepath.Walk(skel, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == skel {
+			return err
+		}
+		rel, err := filepath.Rel(skel, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(home, rel)
+
+		switch {
+		case info.IsDir():
+			err = os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
+			}
+		case info.Mode().IsRegular():
+			err = copyFile(path, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Failed copying "+path)
+		}
+		return chown(target, uid, gid)
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// MoveHome moves the home directory under root, as usermod -m does. A
+// missing home directory is not an error.
+func MoveHome(root, from, to string) error {
+	src, err := homePath(root, from)
+	if err != nil {
+		return err
+	}
+	dst, err := homePath(root, to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errors.New("The home directory " + to + " already exists")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrap(err, "Failed creating the parent of the home directory")
+	}
+	return errors.Wrap(os.Rename(src, dst), "Failed moving the home directory")
+}
+
+// RemoveHome removes the home directory of the user under root, as
+// userdel -r does. The directory is kept if it's not owned by the uid of the
+// user or if it's the home of one of the users.
+func RemoveHome(root string, u UserPasswd, users map[string]UserPasswd) error {
+	home, err := homePath(root, u.Homedir)
+	if err != nil {
+		return err
+	}
+
+	for name, other := range users {
+		if name != u.Username && filepath.Clean(other.Homedir) == filepath.Clean(u.Homedir) {
+			return errors.New("The home directory " + u.Homedir + " is also used by " + name)
+		}
+	}
+
+	info, err := os.Lstat(home)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Failed reading the home directory")
+	}
+	if uid, ok := fileOwner(info); !ok || uid != u.Uid {
+		return errors.New("The home directory " + u.Homedir + " is not owned by " + u.Username)
+	}
+
+	return errors.Wrap(os.RemoveAll(home), "Failed removing the home directory")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GroupMember is a member of a group, by primary gid or listed in the
+// group or gshadow entry.
+type GroupMember struct {
+	Name    string `json:"name" yaml:"name"`
+	Primary bool   `json:"primary" yaml:"primary"`
+}
+
+func listHas(list, name string) bool {
+	for _, m := range strings.Split(list, ",") {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isMember reports whether the user is listed in the group or gshadow
+// entry of the group.
+func (s *EntitiesStore) isMember(group, user string) bool {
+	if g, ok := s.Groups[group]; ok && listHas(g.Users, user) {
+		return true
+	}
+	if g, ok := s.GShadows[group]; ok && listHas(g.Members, user) {
+		return true
+	}
+	return false
+}
+
+// GroupsOf returns the primary group of the user followed by its
+// supplementary groups, sorted by gid, as id(1) does. A primary gid without
+// a group is returned as a group without name.
+func (s *EntitiesStore) GroupsOf(user string) ([]Group, error) {
+	u, ok := s.Users[user]
+	if !ok {
+		return nil, errors.New("The user " + user + " is not present")
+	}
+
+	gid := u.Gid
+	primary := Group{Gid: &gid}
+	supplementary := []Group{}
+	for _, name := range s.names(GroupKind) {
+		g := s.Groups[name]
+		if g.Gid != nil && *g.Gid == u.Gid {
+			primary = g
+		} else if s.isMember(name, user) {
+			supplementary = append(supplementary, g)
+		}
+	}
+
+	sort.SliceStable(supplementary, func(i, j int) bool {
+		return s.id(GroupKind, supplementary[i].Name) < s.id(GroupKind, supplementary[j].Name)
+	})
+
+	return append([]Group{primary}, supplementary...), nil
+}
+
+// Members returns the users with the group as primary group, followed by
+// the ones listed in the group or gshadow entry, each sorted by name.
+func (s *EntitiesStore) Members(group string) ([]GroupMember, error) {
+	g, ok := s.Groups[group]
+	if !ok {
+		return nil, errors.New("The group " + group + " is not present")
+	}
+
+	members := []GroupMember{}
+	seen := make(map[string]bool)
+	for _, name := range s.names(UserKind) {
+		if g.Gid != nil && s.Users[name].Gid == *g.Gid {
+			members = append(members, GroupMember{Name: name, Primary: true})
+			seen[name] = true
+		}
+	}
+
+	lists := g.Users
+	if gs, ok := s.GShadows[group]; ok {
+		lists += "," + gs.Members
+	}
+	explicit := []string{}
+	for _, m := range strings.Split(lists, ",") {
+		if m != "" && !seen[m] {
+			seen[m] = true
+			explicit = append(explicit, m)
+		}
+	}
+	sort.Strings(explicit)
+	for _, m := range explicit {
+		members = append(members, GroupMember{Name: m})
+	}
+
+	return members, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Membership", func() {
+	var store *EntitiesStore
+
+	gid := func(id int) *int { return &id }
+
+	BeforeEach(func() {
+		store = NewEntitiesStore()
+		store.AddUser(UserPasswd{Username: "foo", Uid: 1000, Gid: 1000})
+		store.AddUser(UserPasswd{Username: "bar", Uid: 1001, Gid: 1000})
+		store.AddUser(UserPasswd{Username: "orphan", Uid: 1002, Gid: 2000})
+		store.AddGroup(Group{Name: "foo", Gid: gid(1000)})
+		store.AddGroup(Group{Name: "wheel", Gid: gid(10), Users: "foo"})
+		store.AddGroup(Group{Name: "audio", Gid: gid(18), Users: "bar,foo"})
+		store.AddGroup(Group{Name: "video", Gid: gid(27)})
+		store.AddGShadow(GShadow{Name: "video", Members: "foo,gone"})
+	})
+
+	It("resolves the groups of a user", func() {
+		groups, err := store.GroupsOf("foo")
+		Expect(err).Should(BeNil())
+
+		names := []string{}
+		for _, g := range groups {
+			names = append(names, g.Name)
+		}
+		Expect(names).To(Equal([]string{"foo", "wheel", "audio", "video"}))
+
+		groups, err = store.GroupsOf("orphan")
+		Expect(err).Should(BeNil())
+		Expect(groups).To(Equal([]Group{{Gid: gid(2000)}}))
+
+		_, err = store.GroupsOf("nope")
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("lists the members of a group", func() {
+		members, err := store.Members("foo")
+		Expect(err).Should(BeNil())
+		Expect(members).To(Equal([]GroupMember{
+			{Name: "bar", Primary: true},
+			{Name: "foo", Primary: true},
+		}))
+
+		members, err = store.Members("video")
+		Expect(err).Should(BeNil())
+		Expect(members).To(Equal([]GroupMember{{Name: "foo"}, {Name: "gone"}}))
+
+		_, err = store.Members("nope")
+		Expect(err).ShouldNot(BeNil())
+	})
+})
@@ -0,0 +1,181 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LineError is an error found processing a line of an input file.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+// NewUsers creates the users described by the passwd-style lines of r, as
+// newusers(8) does:
+//
+//	name:password:uid:gid:gecos:home:shell
+//
+// An empty uid is allocated dynamically. The gid can be a group name or
+// a number; missing groups are created together with their gshadow entry,
+// and an empty gid creates a group named as the user. The plaintext
+// password is hashed in the shadow entry, an empty one locks the user.
+//
+// Lines with errors are skipped and returned, the others are written with
+// a single rewrite of each file.
+func NewUsers(f Files, r io.Reader) ([]LineError, error) {
+	t := NewTransaction(f)
+	t.Track = true
+	defer t.Close()
+
+	lineErrors := []LineError{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		sp, err := t.savepoint()
+		if err != nil {
+			return lineErrors, err
+		}
+
+		if err := t.newUser(line); err != nil {
+			t.rollback(sp)
+			lineErrors = append(lineErrors, LineError{Line: n, Err: err})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return lineErrors, errors.Wrap(err, "Failed reading input")
+	}
+
+	return lineErrors, t.Commit()
+}
+
+// newUser adds the entities of a newusers line. Errors never contain
+// the password.
+func (t *Transaction) newUser(line string) error {
+	fs := strings.Split(line, ":")
+	if len(fs) != 7 {
+		return errors.New("Unexpected number of fields: found " + strconv.Itoa(len(fs)))
+	}
+	name, password, uidField, gidField := fs[0], fs[1], fs[2], fs[3]
+
+	if name == "" {
+		return errors.New("Empty username field")
+	}
+
+	users, err := t.db(UserKind)
+	if err != nil {
+		return err
+	}
+	if _, ok := users.get(name); ok {
+		return errors.New("User " + name + " already present")
+	}
+
+	user := UserPasswd{
+		Username: name,
+		Password: "x",
+		Uid:      -1,
+		Info:     fs[4],
+		Homedir:  fs[5],
+		Shell:    fs[6],
+	}
+
+	if uidField != "" {
+		user.Uid, err = strconv.Atoi(uidField)
+		if err != nil || user.Uid < 0 {
+			return errors.New("Invalid uid " + uidField)
+		}
+		used, err := t.usedIDs(UserKind)
+		if err != nil {
+			return err
+		}
+		if _, ok := used[user.Uid]; ok {
+			return errors.New("Uid " + uidField + " is already used")
+		}
+	}
+
+	groups, err := t.groups()
+	if err != nil {
+		return err
+	}
+
+	// Group to create if missing
+	newGroup := Group{Name: name, Password: "x"}
+	gid := -1
+	newGroup.Gid = &gid
+
+	if id, err := strconv.Atoi(gidField); err == nil {
+		found := false
+		for _, g := range groups {
+			if *g.Gid == id {
+				newGroup.Name = g.Name
+				found = true
+				break
+			}
+		}
+		if !found {
+			if _, ok := groups[name]; ok {
+				return errors.New("Group " + name + " already present with a different gid")
+			}
+			gid = id
+		}
+	} else if gidField != "" {
+		newGroup.Name = gidField
+	}
+
+	if _, ok := groups[newGroup.Name]; !ok {
+		if err := t.Create(newGroup); err != nil {
+			return err
+		}
+		gshadows, err := t.db(GShadowKind)
+		if err != nil {
+			return err
+		}
+		if _, ok := gshadows.get(newGroup.Name); !ok {
+			if err := t.Create(GShadow{Name: newGroup.Name, Password: "!"}); err != nil {
+				return err
+			}
+		}
+	}
+	user.Group = newGroup.Name
+
+	if err := t.Create(user); err != nil {
+		return err
+	}
+
+	if password == "" {
+		password = "!"
+	}
+	return t.Create(Shadow{
+		Username:    name,
+		Password:    password,
+		LastChanged: "now",
+	})
+}
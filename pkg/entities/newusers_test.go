@@ -0,0 +1,136 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newTestRoot creates a root directory with the identity files of the
+// fixtures.
+func newTestRoot() (string, Files) {
+	root, err := os.MkdirTemp(os.TempDir(), "root-")
+	Expect(err).Should(BeNil())
+	Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).Should(BeNil())
+
+	files := NewFiles(root)
+	for src, dst := range map[string]string{
+		"../../testing/fixtures/simple/passwd":   files.Passwd,
+		"../../testing/fixtures/shadow/shadow":   files.Shadow,
+		"../../testing/fixtures/group/group":     files.Group,
+		"../../testing/fixtures/gshadow/gshadow": files.GShadow,
+	} {
+		_, err = copy(src, dst)
+		Expect(err).Should(BeNil())
+	}
+
+	return root, files
+}
+
+// newEmptyRoot creates a root directory without identity files, to be
+// written by the tests, and with the state disabled.
+func newEmptyRoot() (string, Files) {
+	root, err := os.MkdirTemp(os.TempDir(), "root-")
+	Expect(err).Should(BeNil())
+	Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).Should(BeNil())
+
+	files := NewFiles(root)
+	files.State = ""
+	return root, files
+}
+
+func writeFile(path, content string) {
+	Expect(os.WriteFile(path, []byte(content), 0644)).Should(BeNil())
+}
+
+func readFile(path string) string {
+	data, err := os.ReadFile(path)
+	Expect(err).Should(BeNil())
+	return string(data)
+}
+
+var _ = Describe("NewUsers", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("creates users, groups and shadow entries", func() {
+		input := `alice:pw1:::Alice:/home/alice:/bin/bash
+bob:pw2::ntp:Bob:/home/bob:/bin/sh
+broken:line
+carol::2000:5000:Carol:/home/carol:/bin/sh
+root:x:::::
+`
+		lineErrors, err := NewUsers(files, strings.NewReader(input))
+		Expect(err).Should(BeNil())
+		Expect(lineErrors).To(HaveLen(2))
+		Expect(lineErrors[0].Line).To(Equal(3))
+		Expect(lineErrors[1].Line).To(Equal(5))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users["alice"].Uid).To(Equal(1000))
+		Expect(users["alice"].Gid).To(Equal(1000))
+		Expect(users["bob"].Uid).To(Equal(1001))
+		Expect(users["bob"].Gid).To(Equal(123))
+		Expect(users["carol"].Uid).To(Equal(2000))
+		Expect(users["carol"].Gid).To(Equal(5000))
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(*groups["alice"].Gid).To(Equal(1000))
+		Expect(*groups["carol"].Gid).To(Equal(5000))
+		Expect(groups).ToNot(HaveKey("bob"))
+
+		gshadows, err := ParseGShadow(files.GShadow)
+		Expect(err).Should(BeNil())
+		Expect(gshadows["alice"].Password).To(Equal("!"))
+
+		shadows, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(PasswordMatch(shadows["alice"].Password, "pw1")).To(BeTrue())
+		Expect(PasswordMatch(shadows["bob"].Password, "pw2")).To(BeTrue())
+		Expect(shadows["carol"].Password).To(Equal("!"))
+	})
+
+	It("doesn't leave partial entries of failed lines", func() {
+		lineErrors, err := NewUsers(files, strings.NewReader("dave:pw::newgroup::/home/dave:/bin/sh\n"+
+			"halt:pw::othergroup::/home/halt:/bin/sh\n"))
+		Expect(err).Should(BeNil())
+		Expect(lineErrors).To(HaveLen(1))
+		Expect(lineErrors[0].Error()).ToNot(ContainSubstring("pw"))
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(groups).To(HaveKey("newgroup"))
+		Expect(groups).ToNot(HaveKey("othergroup"))
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users).ToNot(HaveKey("halt"))
+	})
+})
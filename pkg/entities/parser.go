@@ -14,7 +14,11 @@ limitations under the License.
 package entities
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
@@ -83,11 +87,100 @@ func (p Parser) ReadEntityFromBytes(yamlFile []byte) (Entity, error) {
 
 	return nil, errors.New("Unsupported format")
 }
+
+// ReadEntityFromJSON parses the JSON encoding of an entity of the given kind.
+func (p Parser) ReadEntityFromJSON(kind string, data []byte) (Entity, error) {
+	var e Entity
+	var err error
+
+	switch kind {
+	case UserKind:
+		var user UserPasswd
+		err = json.Unmarshal(data, &user)
+		e = user
+	case ShadowKind:
+		var shad Shadow
+		err = json.Unmarshal(data, &shad)
+		e = shad
+	case GroupKind:
+		var group Group
+		err = json.Unmarshal(data, &group)
+		e = group
+	case GShadowKind:
+		var group GShadow
+		err = json.Unmarshal(data, &group)
+		e = group
+	default:
+		return nil, errors.New("Unsupported kind " + kind)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed while parsing entity")
+	}
+	return e, nil
+}
+
 func (p Parser) ReadEntity(entity string) (Entity, error) {
 	yamlFile, err := os.ReadFile(entity)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed while reading entity file")
 	}
-	return p.ReadEntityFromBytes(yamlFile)
+	e, err := p.ReadEntityFromBytes(yamlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return withPolicy(e, entity)
+}
+
+// ReadEntities parses all the documents of a multi-document spec file, as
+// written by entities export.
+func (p Parser) ReadEntities(entity string) ([]Entity, error) {
+	yamlFile, err := os.ReadFile(entity)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed while reading entity file")
+	}
 
+	ans := []Entity{}
+	dec := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	for {
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Failed while parsing entity file")
+		}
+
+		doc, err := yaml.Marshal(&node)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed while parsing entity file")
+		}
+		e, err := p.ReadEntityFromBytes(doc)
+		if err != nil {
+			return nil, err
+		}
+		if e, err = withPolicy(e, entity); err != nil {
+			return nil, err
+		}
+		ans = append(ans, e)
+	}
+
+	return ans, nil
+}
+
+// withPolicy attaches to shadow entities the password policy of the specs
+// directory of the file.
+func withPolicy(e Entity, entity string) (Entity, error) {
+	shad, ok := e.(Shadow)
+	if !ok {
+		return e, nil
+	}
+
+	var err error
+	shad.Policy, err = LoadPasswordPolicy(filepath.Dir(entity))
+	if err != nil {
+		return nil, err
+	}
+	return shad, nil
 }
@@ -14,6 +14,8 @@ limitations under the License.
 package entities_test
 
 import (
+	"encoding/json"
+
 	. "github.com/mudler/entities/pkg/entities"
 
 	. "github.com/onsi/ginkgo"
@@ -44,4 +46,28 @@ var _ = Describe("Parser", func() {
 			Expect(entity.(GShadow).Name).Should(Equal("test"))
 		})
 	})
+
+	Context("Loading entities via json", func() {
+		p := &Parser{}
+		It("decodes the entity of the given kind", func() {
+			gid := 100
+			for _, e := range []Entity{
+				UserPasswd{Username: "foo", Password: "x", Uid: 1000, Gid: 100, Shell: "/bin/sh"},
+				Group{Name: "foo", Password: "x", Gid: &gid, Users: "foo"},
+				Shadow{Username: "foo", Password: "!", LastChanged: "1"},
+				GShadow{Name: "foo", Password: "!", Members: "foo"},
+			} {
+				data, err := json.Marshal(e)
+				Expect(err).Should(BeNil())
+
+				decoded, err := p.ReadEntityFromJSON(e.GetKind(), data)
+				Expect(err).Should(BeNil())
+				Expect(decoded).To(Equal(e))
+			}
+		})
+		It("fails with unknown kinds", func() {
+			_, err := p.ReadEntityFromJSON("foo", []byte("{}"))
+			Expect(err).ToNot(BeNil())
+		})
+	})
 })
@@ -0,0 +1,238 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tredoe/osutil/user/crypt"
+	"github.com/tredoe/osutil/user/crypt/md5_crypt"
+	"github.com/tredoe/osutil/user/crypt/sha256_crypt"
+	"github.com/tredoe/osutil/user/crypt/sha512_crypt"
+)
+
+const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func randStringBytes(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return string(b)
+}
+
+func encryptPassword(userPassword string) (string, error) {
+	salt := []byte(fmt.Sprintf("$6$%s", randStringBytes(8)))
+	c := sha512_crypt.New()
+	hash, err := c.Generate([]byte(userPassword), salt)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isPlainPassword reports whether p is a cleartext password that must be
+// hashed before being written.
+func isPlainPassword(p string) bool {
+	/*
+	 A password field which starts with an exclamation mark means
+	 that the password is locked. The remaining characters on the
+	 line represent the password field before the password was
+	 locked.
+
+	 Refer to crypt(3) for details on how this string is
+	 interpreted.
+
+	 If the password field contains some string that is not a
+	 valid result of crypt(3), for instance ! or *, the user will
+	 not be able to use a unix password to log in (but the user
+	 may log in the system by other means).
+	*/
+	return p != "" && !strings.HasPrefix(p, "$") &&
+		!strings.HasPrefix(p, "!") && p != "*"
+}
+
+// hashPassword returns the crypt(3) hash of a plaintext password. Empty
+// passwords, lock markers and already hashed passwords are returned as is.
+func hashPassword(p string) (string, error) {
+	if !isPlainPassword(p) {
+		return p, nil
+	}
+	return encryptPassword(p)
+}
+
+func crypterFromHash(hash string) crypt.Crypter {
+	switch {
+	case strings.HasPrefix(hash, sha512_crypt.MagicPrefix):
+		return sha512_crypt.New()
+	case strings.HasPrefix(hash, sha256_crypt.MagicPrefix):
+		return sha256_crypt.New()
+	case strings.HasPrefix(hash, md5_crypt.MagicPrefix):
+		return md5_crypt.New()
+	}
+	return nil
+}
+
+// PasswordMatch reports whether the password defined in a spec matches the
+// one stored in the system files. A plaintext password matches the stored
+// hash it verifies against.
+func PasswordMatch(current, desired string) bool {
+	if current == desired {
+		return true
+	}
+
+	if !isPlainPassword(desired) {
+		return false
+	}
+
+	c := crypterFromHash(current)
+	if c == nil {
+		return false
+	}
+
+	return c.Verify(current, []byte(desired)) == nil
+}
+
+// RedactedPassword replaces the passwords hidden by RedactPassword
+const RedactedPassword = "<redacted>"
+
+// RedactPassword hides a password or hash, keeping the lock marker and the
+// placeholders (empty, "x" and "*") that don't disclose anything.
+func RedactPassword(p string) string {
+	v := strings.TrimLeft(p, "!")
+	if v == "" || v == "x" || v == "*" {
+		return p
+	}
+	return p[:len(p)-len(v)] + RedactedPassword
+}
+
+// RedactEntity returns the entity with the password redacted.
+func RedactEntity(e Entity) Entity {
+	return withPassword(e, RedactPassword(entityPassword(e)))
+}
+
+// PasswordSource defines where the password of an entity is read from when
+// it is not written in the spec file.
+type PasswordSource struct {
+	// File containing the password. Trailing newlines are ignored.
+	PasswordFile string `yaml:"password_file,omitempty"`
+	// Environment variable containing the password.
+	PasswordEnv string `yaml:"password_env,omitempty"`
+	// Command executed with /bin/sh. The password is read from its stdout.
+	PasswordCommand string `yaml:"password_command,omitempty"`
+	// Generate a random password and store it in GenerateOutput.
+	Generate       bool   `yaml:"generate,omitempty"`
+	GenerateOutput string `yaml:"generate_output,omitempty"`
+}
+
+const generatedPasswordLength = 24
+
+func (p PasswordSource) isSet() bool {
+	return p.count() > 0
+}
+
+func (p PasswordSource) count() int {
+	n := 0
+	for _, set := range []bool{
+		p.PasswordFile != "", p.PasswordEnv != "", p.PasswordCommand != "", p.Generate,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve returns the password defined by the source. Errors never contain
+// the password itself.
+func (p PasswordSource) resolve() (string, error) {
+	if p.count() > 1 {
+		return "", errors.New("Only one of password_file, password_env, password_command and generate can be used")
+	}
+
+	var pwd string
+	switch {
+	case p.PasswordFile != "":
+		data, err := os.ReadFile(p.PasswordFile)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed reading password file")
+		}
+		pwd = strings.TrimRight(string(data), "\r\n")
+	case p.PasswordEnv != "":
+		v, ok := os.LookupEnv(p.PasswordEnv)
+		if !ok {
+			return "", errors.New("Environment variable " + p.PasswordEnv + " is not set")
+		}
+		pwd = v
+	case p.PasswordCommand != "":
+		cmd := exec.Command("/bin/sh", "-c", p.PasswordCommand)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.Wrap(err, "Failed running password command")
+		}
+		pwd = strings.TrimRight(string(out), "\r\n")
+	case p.Generate:
+		return generatePassword(p.GenerateOutput)
+	}
+
+	if pwd == "" {
+		return "", errors.New("Empty password from password source")
+	}
+
+	return pwd, nil
+}
+
+// generatePassword returns the password stored in output, generating and
+// writing a new one with 0600 permissions only if the file doesn't exist yet.
+func generatePassword(output string) (string, error) {
+	if output == "" {
+		return "", errors.New("generate requires generate_output to store the password")
+	}
+
+	if data, err := os.ReadFile(output); err == nil {
+		return strings.TrimRight(string(data), "\r\n"), nil
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "Failed reading generated password file")
+	}
+
+	b := make([]byte, generatedPasswordLength)
+	max := big.NewInt(int64(len(letterBytes)))
+	for i := range b {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed generating password")
+		}
+		b[i] = letterBytes[n.Int64()]
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed creating generated password file")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return "", errors.Wrap(err, "Failed writing generated password file")
+	}
+
+	return string(b), nil
+}
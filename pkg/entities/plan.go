@@ -0,0 +1,261 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FileChange is the change of an identity file computed by Plan.
+type FileChange struct {
+	Kind   string
+	Path   string
+	Before []byte
+	After  []byte
+}
+
+// Plan runs fn on a dry run transaction over the identity files and returns
+// the changes it would do. Nothing is written and the password sources are
+// not resolved.
+func Plan(f Files, fn func(t *Transaction) error) ([]FileChange, error) {
+	t := NewTransaction(f)
+	t.DryRun = true
+	defer t.Close()
+
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+
+	return t.Changes(), nil
+}
+
+// Changes returns the files modified by the transaction, in the order they
+// are written by Commit.
+func (t *Transaction) Changes() []FileChange {
+	ans := []FileChange{}
+	for _, kind := range transactionKinds {
+		d, ok := t.dbs[kind]
+		if !ok {
+			continue
+		}
+		after := d.content()
+		if bytes.Equal(d.original, after) {
+			continue
+		}
+		ans = append(ans, FileChange{
+			Kind:   kind,
+			Path:   d.path,
+			Before: d.original,
+			After:  after,
+		})
+	}
+	return ans
+}
+
+// Delete removes the entity with the name of e, if present. Entities not
+// owned by entities, or all of them without a state, are not removed unless
+// Force is set.
+func (t *Transaction) Delete(e Entity) error {
+	d, err := t.db(e.GetKind())
+	if err != nil {
+		return err
+	}
+
+	name := EntityName(e)
+	if _, ok := d.get(name); !ok {
+		return nil
+	}
+
+	st, err := t.State()
+	if err != nil {
+		return err
+	}
+	if !t.Force && st == nil {
+		return errors.New(fmt.Sprintf(
+			"The %s %s can't be checked to be managed by entities without a state", e.GetKind(), name))
+	}
+	if !t.Force && !st.Owns(e.GetKind(), name) {
+		return errors.New(fmt.Sprintf("The %s %s is not managed by entities", e.GetKind(), name))
+	}
+
+	d.remove(name)
+	t.touch(e.GetKind(), name)
+
+	return nil
+}
+
+// UnifiedDiff returns the change in unified diff format. Password fields
+// are redacted, keeping only the lock marker and the placeholders.
+func (c FileChange) UnifiedDiff() string {
+	return unifiedDiff(c.Path, splitLines(c.Before), splitLines(c.After))
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
+
+// redactLine hides the password field (the second one in all the identity
+// files) of a line.
+func redactLine(line string) string {
+	fs := strings.Split(line, ":")
+	if len(fs) < 2 {
+		return line
+	}
+
+	fs[1] = RedactPassword(fs[1])
+
+	return strings.Join(fs, ":")
+}
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// diffLines computes the line edit script from a to b with the longest
+// common subsequence, after stripping the common prefix and suffix.
+func diffLines(a, b []string) []diffLine {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	ans := []diffLine{}
+	for _, l := range a[:pre] {
+		ans = append(ans, diffLine{' ', l})
+	}
+
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	// lcs[i][j] is the length of the common subsequence of ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			switch {
+			case ma[i] == mb[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ans = append(ans, diffLine{' ', ma[i]})
+			i++
+			j++
+		case j < len(mb) && (i == len(ma) || lcs[i][j+1] > lcs[i+1][j]):
+			ans = append(ans, diffLine{'+', mb[j]})
+			j++
+		default:
+			ans = append(ans, diffLine{'-', ma[i]})
+			i++
+		}
+	}
+
+	for _, l := range a[len(a)-suf:] {
+		ans = append(ans, diffLine{' ', l})
+	}
+
+	return ans
+}
+
+const diffContext = 3
+
+func unifiedDiff(path string, a, b []string) string {
+	lines := diffLines(a, b)
+
+	// Line numbers in a and b before each line of the script
+	aNum := make([]int, len(lines)+1)
+	bNum := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aNum[i+1], bNum[i+1] = aNum[i], bNum[i]
+		if l.op != '+' {
+			aNum[i+1]++
+		}
+		if l.op != '-' {
+			bNum[i+1]++
+		}
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", path, path)
+
+	for start := 0; start < len(lines); {
+		for start < len(lines) && lines[start].op == ' ' {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// Changes closer than two contexts are joined in the same hunk
+		end := start
+		for i := start; i < len(lines); i++ {
+			if lines[i].op != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+
+		hs := start - diffContext
+		if hs < 0 {
+			hs = 0
+		}
+		he := end + diffContext
+		if he > len(lines) {
+			he = len(lines)
+		}
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(aNum[hs], aNum[he]-aNum[hs]),
+			hunkRange(bNum[hs], bNum[he]-bNum[hs]))
+		for _, l := range lines[hs:he] {
+			fmt.Fprintf(&buf, "%c%s\n", l.op, redactLine(l.text))
+		}
+
+		start = he
+	}
+
+	return buf.String()
+}
+
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
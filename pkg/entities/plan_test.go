@@ -0,0 +1,125 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plan", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("computes the changes without writing them", func() {
+		before, err := os.ReadFile(files.Passwd)
+		Expect(err).Should(BeNil())
+
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+
+		changes, err := store.Plan(files, false)
+		Expect(err).Should(BeNil())
+		Expect(changes).To(HaveLen(4))
+		Expect(changes[2].Kind).To(Equal(UserKind))
+		Expect(changes[2].Before).To(Equal(before))
+		Expect(string(changes[2].After)).To(ContainSubstring("web:x:1000:1000:"))
+
+		after, err := os.ReadFile(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(after).To(Equal(before))
+	})
+
+	It("returns no changes when the entity is already present", func() {
+		changes, err := Plan(files, func(t *Transaction) error {
+			_, err := t.Apply(UserPasswd{
+				Username: "bin",
+				Password: "x",
+				Uid:      1,
+				Gid:      1,
+				Info:     "bin",
+				Homedir:  "/bin",
+				Shell:    "/bin/false",
+			}, false)
+			return err
+		})
+		Expect(err).Should(BeNil())
+		Expect(changes).To(BeEmpty())
+	})
+
+	It("doesn't resolve the password sources", func() {
+		ran := filepath.Join(root, "ran")
+		generated := filepath.Join(root, "generated")
+
+		changes, err := Plan(files, func(t *Transaction) error {
+			if _, err := t.Apply(Shadow{
+				Username:       "halt",
+				PasswordSource: PasswordSource{PasswordCommand: "touch " + ran + "; echo secret"},
+			}, false); err != nil {
+				return err
+			}
+			_, err := t.Apply(Shadow{
+				Username:       "foo",
+				PasswordSource: PasswordSource{Generate: true, GenerateOutput: generated},
+			}, false)
+			return err
+		})
+		Expect(err).Should(BeNil())
+		Expect(changes).To(HaveLen(1))
+		Expect(changes[0].UnifiedDiff()).To(ContainSubstring("+foo:" + RedactedPassword + ":"))
+		Expect(changes[0].UnifiedDiff()).ToNot(ContainSubstring("halt"))
+
+		Expect(ran).ToNot(BeAnExistingFile())
+		Expect(generated).ToNot(BeAnExistingFile())
+	})
+
+	It("prints a unified diff with redacted passwords", func() {
+		changes, err := Plan(files, func(t *Transaction) error {
+			_, err := t.Apply(Shadow{Username: "lp", Password: "Secret", LastChanged: "9797"}, false)
+			return err
+		})
+		Expect(err).Should(BeNil())
+		Expect(changes).To(HaveLen(1))
+
+		diff := changes[0].UnifiedDiff()
+		Expect(diff).To(HavePrefix("--- " + files.Shadow + "\n+++ " + files.Shadow + "\n@@ -5,6 +5,6 @@\n"))
+		Expect(diff).To(ContainSubstring("\n-lp:*:9797:0:::::\n+lp:<redacted>:9797:0:::::\n"))
+		Expect(diff).ToNot(ContainSubstring("$6$"))
+	})
+
+	It("shows deletions", func() {
+		changes, err := Plan(files, func(t *Transaction) error {
+			t.Force = true
+			return t.Delete(Shadow{Username: "lp"})
+		})
+		Expect(err).Should(BeNil())
+		Expect(changes).To(HaveLen(1))
+		Expect(changes[0].UnifiedDiff()).To(ContainSubstring("\n-lp:*:9797:0:::::\n"))
+	})
+})
@@ -0,0 +1,196 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// PasswordPolicyFile is the name of the file, inside a specs directory,
+// defining the policy applied to the passwords of the specs of the directory.
+const PasswordPolicyFile = "password_policy.yaml"
+
+// PasswordPolicy defines the rules that plaintext passwords must satisfy
+// before being hashed.
+type PasswordPolicy struct {
+	MinLength int `yaml:"min_length"`
+	// Minimum number of different classes (lower, upper, digit, symbol)
+	MinClasses    int  `yaml:"min_classes"`
+	RequireLower  bool `yaml:"require_lower"`
+	RequireUpper  bool `yaml:"require_upper"`
+	RequireDigit  bool `yaml:"require_digit"`
+	RequireSymbol bool `yaml:"require_symbol"`
+	// File with a forbidden password for each line. Relative paths are
+	// resolved from the directory of the policy file.
+	Dictionary string `yaml:"dictionary"`
+	// Reject passwords containing the username
+	ForbidUsername bool `yaml:"forbid_username"`
+	// Users not subject to the policy
+	Exempt []string `yaml:"exempt"`
+
+	words map[string]struct{}
+}
+
+// ReadPasswordPolicy parses a password policy file.
+func ReadPasswordPolicy(path string) (*PasswordPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed while reading password policy file")
+	}
+
+	p := &PasswordPolicy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrap(err, "Failed while parsing password policy file")
+	}
+
+	if p.Dictionary != "" {
+		dict := p.Dictionary
+		if !filepath.IsAbs(dict) {
+			dict = filepath.Join(filepath.Dir(path), dict)
+		}
+		if err := p.loadDictionary(dict); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// LoadPasswordPolicy returns the password policy of a specs directory. The
+// policy defined by the ENTITY_PASSWORD_POLICY environment variable is used
+// when the directory doesn't have one. It returns nil if no policy is defined.
+func LoadPasswordPolicy(dir string) (*PasswordPolicy, error) {
+	path := filepath.Join(dir, PasswordPolicyFile)
+	if _, err := os.Stat(path); err != nil {
+		path = os.Getenv(ENTITY_ENV_DEF_POLICY)
+		if path == "" {
+			return nil, nil
+		}
+	}
+
+	return ReadPasswordPolicy(path)
+}
+
+func (p *PasswordPolicy) loadDictionary(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed while reading password dictionary")
+	}
+	defer f.Close()
+
+	p.words = make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		w := strings.TrimSpace(scanner.Text())
+		if w != "" {
+			p.words[strings.ToLower(w)] = struct{}{}
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (p *PasswordPolicy) isExempt(username string) bool {
+	for _, e := range p.Exempt {
+		if e == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates the plaintext password of a user against the policy.
+// Locked passwords (! or *), hashes and exempted users are not checked.
+// The returned error never contains the password.
+func (p *PasswordPolicy) Check(username, password string) error {
+	if !isPlainPassword(password) {
+		return nil
+	}
+	return p.checkPlain(username, password)
+}
+
+// checkPlain is Check for a password known to be in cleartext, whatever
+// it looks like.
+func (p *PasswordPolicy) checkPlain(username, password string) error {
+	if p == nil || p.isExempt(username) {
+		return nil
+	}
+
+	violations := []string{}
+
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations,
+			fmt.Sprintf("shorter than %d characters", p.MinLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, c := range []struct {
+		present, required bool
+		descr             string
+	}{
+		{lower, p.RequireLower, "a lowercase letter"},
+		{upper, p.RequireUpper, "an uppercase letter"},
+		{digit, p.RequireDigit, "a digit"},
+		{symbol, p.RequireSymbol, "a symbol"},
+	} {
+		if c.present {
+			classes++
+		} else if c.required {
+			violations = append(violations, "missing "+c.descr)
+		}
+	}
+
+	if classes < p.MinClasses {
+		violations = append(violations,
+			fmt.Sprintf("uses %d character classes instead of %d", classes, p.MinClasses))
+	}
+
+	if _, ok := p.words[strings.ToLower(password)]; ok {
+		violations = append(violations, "found in the dictionary")
+	}
+
+	if p.ForbidUsername && username != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, "contains the username")
+	}
+
+	if len(violations) > 0 {
+		return errors.New(fmt.Sprintf("Password of %s violates the policy: %s",
+			username, strings.Join(violations, ", ")))
+	}
+
+	return nil
+}
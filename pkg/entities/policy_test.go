@@ -0,0 +1,81 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PasswordPolicy", func() {
+	Context("Loading entities via yaml", func() {
+		p := &Parser{}
+
+		apply := func(spec string) error {
+			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
+			if err != nil {
+				fmt.Println("Cannot create temporary file", err)
+			}
+
+			// cleaning up by removing the file
+			defer os.Remove(tmpFile.Name())
+
+			entity, err := p.ReadEntity(spec)
+			Expect(err).Should(BeNil())
+			Expect(entity.(Shadow).Policy).ToNot(BeNil())
+
+			return entity.Apply(tmpFile.Name(), false)
+		}
+
+		It("rejects weak passwords", func() {
+			err := apply("../../testing/fixtures/policy/weak.yaml")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("found in the dictionary"))
+			Expect(err.Error()).ToNot(ContainSubstring("Password123"))
+		})
+
+		It("accepts passwords satisfying the policy", func() {
+			Expect(apply("../../testing/fixtures/policy/strong.yaml")).Should(BeNil())
+		})
+
+		It("doesn't check locked and exempted accounts", func() {
+			Expect(apply("../../testing/fixtures/policy/locked.yaml")).Should(BeNil())
+			Expect(apply("../../testing/fixtures/policy/exempt.yaml")).Should(BeNil())
+		})
+	})
+
+	It("reports every violation", func() {
+		policy := &PasswordPolicy{
+			MinLength:      8,
+			RequireUpper:   true,
+			RequireSymbol:  true,
+			ForbidUsername: true,
+		}
+
+		err := policy.Check("foo", "foo1")
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("shorter than 8 characters"))
+		Expect(err.Error()).To(ContainSubstring("missing an uppercase letter"))
+		Expect(err.Error()).To(ContainSubstring("missing a symbol"))
+		Expect(err.Error()).To(ContainSubstring("contains the username"))
+
+		Expect(policy.Check("foo", "B@r-baz-qux")).Should(BeNil())
+		Expect(policy.Check("foo", "*")).Should(BeNil())
+	})
+})
@@ -0,0 +1,416 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query selects entities with comparisons of their fields joined by &&
+// and ||, negated with ! and grouped with parentheses, e.g.
+//
+//	uid>=1000 && shell!=/sbin/nologin
+//	member=wheel || (expired=true && !locked=true)
+//
+// The operators are =, !=, <, <=, >, >=, ~ and !~ (regex match). Values are
+// compared as numbers when both are integers. Values with spaces or
+// operator characters can be quoted with double quotes.
+//
+// Users and shadow entries share the fields of both, joined by name, as
+// groups and gshadow entries do. See QueryFields.
+type Query struct {
+	src  string
+	root queryNode
+}
+
+// QueryFields are the fields available to the queries. member is the
+// list of the groups of a user or of the members of a group: = and ~ match
+// if any of them matches.
+var QueryFields = []string{
+	"kind", "name", "uid", "gid", "group", "info", "homedir", "shell",
+	"locked", "expired", "last_changed", "minimum_changed", "maximum_changed",
+	"warn", "inactive", "expire", "users", "administrators", "members", "member",
+}
+
+// ParseQuery compiles the query.
+func ParseQuery(q string) (*Query, error) {
+	p := &queryParser{src: q}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("Empty query")
+	}
+
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New(fmt.Sprintf("Unexpected %q in query", p.tokens[p.pos].value))
+	}
+
+	return &Query{src: q, root: root}, nil
+}
+
+func (q *Query) String() string {
+	return q.src
+}
+
+// Match reports whether the entity of the kind with the name in the store
+// is selected by the query.
+func (q *Query) Match(s *EntitiesStore, kind, name string) bool {
+	return q.root.eval(s.queryRecord(kind, name, time.Now()))
+}
+
+// queryRecord is the set of values of each field of an entity.
+type queryRecord map[string][]string
+
+func (r queryRecord) set(field, value string) {
+	r[field] = []string{value}
+}
+
+// queryRecord returns the fields of the entity, joined with the ones of
+// its user or group and shadow entries.
+func (s *EntitiesStore) queryRecord(kind, name string, now time.Time) queryRecord {
+	r := queryRecord{}
+	r.set("kind", kind)
+	r.set("name", name)
+
+	switch kind {
+	case UserKind, ShadowKind:
+		if u, ok := s.Users[name]; ok {
+			r.set("uid", strconv.Itoa(u.Uid))
+			r.set("gid", strconv.Itoa(u.Gid))
+			r.set("info", u.Info)
+			r.set("homedir", u.Homedir)
+			r.set("shell", u.Shell)
+			if groups, err := s.GroupsOf(name); err == nil {
+				r.set("group", groups[0].Name)
+				for _, g := range groups {
+					if g.Name != "" {
+						r["member"] = append(r["member"], g.Name)
+					}
+				}
+			}
+		}
+		if sh, ok := s.Shadows[name]; ok {
+			r.set("locked", strconv.FormatBool(strings.HasPrefix(sh.Password, "!")))
+			r.set("last_changed", sh.LastChanged)
+			r.set("minimum_changed", sh.MinimumChanged)
+			r.set("maximum_changed", sh.MaximumChanged)
+			r.set("warn", sh.Warn)
+			r.set("inactive", sh.Inactive)
+			r.set("expire", sh.Expire)
+			if e, err := ShadowExpiry(sh, now, 0); err == nil {
+				switch e.Status {
+				case ExpiryExpired, ExpiryInactive, ExpiryAccountExpired:
+					r.set("expired", "true")
+				default:
+					r.set("expired", "false")
+				}
+			}
+		}
+	case GroupKind, GShadowKind:
+		if g, ok := s.Groups[name]; ok {
+			if g.Gid != nil {
+				r.set("gid", strconv.Itoa(*g.Gid))
+			}
+			r.set("users", g.Users)
+			if members, err := s.Members(name); err == nil {
+				for _, m := range members {
+					r["member"] = append(r["member"], m.Name)
+				}
+			}
+		}
+		if gs, ok := s.GShadows[name]; ok {
+			r.set("locked", strconv.FormatBool(strings.HasPrefix(gs.Password, "!")))
+			r.set("administrators", gs.Administrators)
+			r.set("members", gs.Members)
+			if _, ok := s.Groups[name]; !ok {
+				for _, m := range strings.Split(gs.Members, ",") {
+					if m != "" {
+						r["member"] = append(r["member"], m)
+					}
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+type queryNode interface {
+	eval(r queryRecord) bool
+}
+
+type queryAnd struct{ left, right queryNode }
+
+func (n queryAnd) eval(r queryRecord) bool { return n.left.eval(r) && n.right.eval(r) }
+
+type queryOr struct{ left, right queryNode }
+
+func (n queryOr) eval(r queryRecord) bool { return n.left.eval(r) || n.right.eval(r) }
+
+type queryNot struct{ node queryNode }
+
+func (n queryNot) eval(r queryRecord) bool { return !n.node.eval(r) }
+
+type queryCompare struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// eval matches if any value of the field matches. The negated operators
+// match if no value matches. Missing fields have an empty value.
+func (n queryCompare) eval(r queryRecord) bool {
+	values, ok := r[n.field]
+	if !ok {
+		values = []string{""}
+	}
+
+	switch n.op {
+	case "!=":
+		return !n.any(values, "=")
+	case "!~":
+		return !n.any(values, "~")
+	}
+	return n.any(values, n.op)
+}
+
+func (n queryCompare) any(values []string, op string) bool {
+	for _, v := range values {
+		if n.compare(v, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n queryCompare) compare(v, op string) bool {
+	if op == "~" {
+		return n.re.MatchString(v)
+	}
+
+	var c int
+	a, errA := strconv.Atoi(v)
+	b, errB := strconv.Atoi(n.value)
+	switch {
+	case errA == nil && errB == nil:
+		c = a - b
+	case v < n.value:
+		c = -1
+	case v > n.value:
+		c = 1
+	}
+
+	switch op {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type queryToken struct {
+	// op, word or value
+	kind  string
+	value string
+}
+
+type queryParser struct {
+	src    string
+	tokens []queryToken
+	pos    int
+}
+
+// Operators, the longest first
+var queryOperators = []string{"&&", "||", "!=", "!~", ">=", "<=", "==", "=", "<", ">", "~", "!", "(", ")"}
+
+func (p *queryParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return errors.New("Unterminated quote in query")
+			}
+			p.tokens = append(p.tokens, queryToken{kind: "value", value: s[i+1 : i+1+end]})
+			i += end + 2
+			continue
+		}
+
+		op := ""
+		for _, o := range queryOperators {
+			if strings.HasPrefix(s[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			p.tokens = append(p.tokens, queryToken{kind: "op", value: op})
+			i += len(op)
+			continue
+		}
+
+		// Words end at spaces and at the operators, except inside values
+		// where only spaces, parentheses, && and || end them.
+		afterOp := len(p.tokens) > 0 && p.tokens[len(p.tokens)-1].kind == "op" &&
+			isCompareOp(p.tokens[len(p.tokens)-1].value)
+		j := i
+		for j < len(s) && s[j] != ' ' && s[j] != '\t' && s[j] != ')' && s[j] != '(' &&
+			!strings.HasPrefix(s[j:], "&&") && !strings.HasPrefix(s[j:], "||") {
+			if !afterOp && strings.ContainsAny(s[j:j+1], "=!<>~") {
+				break
+			}
+			j++
+		}
+		kind := "word"
+		if afterOp {
+			kind = "value"
+		}
+		p.tokens = append(p.tokens, queryToken{kind: kind, value: s[i:j]})
+		i = j
+	}
+	return nil
+}
+
+func isCompareOp(op string) bool {
+	switch op {
+	case "=", "==", "!=", "<", "<=", ">", ">=", "~", "!~":
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) peek(value string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && p.tokens[p.pos].value == value
+}
+
+func (p *queryParser) or() (queryNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("||") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = queryOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) and() (queryNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = queryAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) unary() (queryNode, error) {
+	switch {
+	case p.peek("!"):
+		p.pos++
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{n}, nil
+	case p.peek("("):
+		p.pos++
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, errors.New("Missing ) in query")
+		}
+		p.pos++
+		return n, nil
+	}
+	return p.compare()
+}
+
+func (p *queryParser) compare() (queryNode, error) {
+	if p.pos+3 > len(p.tokens) {
+		return nil, errors.New("Incomplete comparison in query")
+	}
+	field, op, value := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	if field.kind != "word" {
+		return nil, errors.New(fmt.Sprintf("Expected a field instead of %q in query", field.value))
+	}
+	if !validQueryField(field.value) {
+		return nil, errors.New("Unknown field " + field.value + " in query")
+	}
+	if op.kind != "op" || !isCompareOp(op.value) {
+		return nil, errors.New(fmt.Sprintf("Expected an operator after %s in query", field.value))
+	}
+	if value.kind != "value" {
+		return nil, errors.New(fmt.Sprintf("Expected a value after %s%s in query", field.value, op.value))
+	}
+	p.pos += 3
+
+	n := queryCompare{field: field.value, op: op.value, value: value.value}
+	if n.op == "==" {
+		n.op = "="
+	}
+	if n.op == "~" || n.op == "!~" {
+		re, err := regexp.Compile(n.value)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid regex in query")
+		}
+		n.re = re
+	}
+	return n, nil
+}
+
+func validQueryField(field string) bool {
+	for _, f := range QueryFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
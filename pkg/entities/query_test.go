@@ -0,0 +1,148 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"regexp"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query", func() {
+	var store *EntitiesStore
+
+	gid := func(id int) *int { return &id }
+
+	match := func(q, kind, name string) bool {
+		query, err := ParseQuery(q)
+		Expect(err).Should(BeNil())
+		return query.Match(store, kind, name)
+	}
+
+	BeforeEach(func() {
+		store = NewEntitiesStore()
+		store.AddUser(UserPasswd{Username: "foo", Uid: 1000, Gid: 1000, Shell: "/bin/bash", Homedir: "/home/foo"})
+		store.AddUser(UserPasswd{Username: "daemon", Uid: 2, Gid: 2, Shell: "/sbin/nologin"})
+		store.AddShadow(Shadow{Username: "foo", Password: "!$6$hash", Expire: "1"})
+		store.AddShadow(Shadow{Username: "daemon", Password: "*"})
+		store.AddGroup(Group{Name: "foo", Gid: gid(1000)})
+		store.AddGroup(Group{Name: "daemon", Gid: gid(2)})
+		store.AddGroup(Group{Name: "wheel", Gid: gid(10), Users: "foo"})
+		store.AddGShadow(GShadow{Name: "wheel", Password: "!", Administrators: "root"})
+	})
+
+	It("compares numbers and strings", func() {
+		Expect(match("uid>=1000 && shell!=/sbin/nologin", UserKind, "foo")).To(BeTrue())
+		Expect(match("uid>=1000 && shell!=/sbin/nologin", UserKind, "daemon")).To(BeFalse())
+		Expect(match("uid<10", UserKind, "daemon")).To(BeTrue())
+		Expect(match("homedir==/home/foo", UserKind, "foo")).To(BeTrue())
+		Expect(match(`info=""`, UserKind, "foo")).To(BeTrue())
+		Expect(match("shell~nologin$", UserKind, "daemon")).To(BeTrue())
+		Expect(match("shell!~^/bin/", UserKind, "foo")).To(BeFalse())
+	})
+
+	It("joins the users with their shadow entries and groups", func() {
+		Expect(match("locked=true && expired=true", UserKind, "foo")).To(BeTrue())
+		Expect(match("expired=true", UserKind, "daemon")).To(BeFalse())
+		Expect(match("uid=1000", ShadowKind, "foo")).To(BeTrue())
+		Expect(match("group=foo", UserKind, "foo")).To(BeTrue())
+
+		Expect(match("member=wheel", UserKind, "foo")).To(BeTrue())
+		Expect(match("member=wheel", UserKind, "daemon")).To(BeFalse())
+		Expect(match("member!=wheel", UserKind, "daemon")).To(BeTrue())
+
+		Expect(match("member=foo && administrators=root", GroupKind, "wheel")).To(BeTrue())
+		Expect(match("member=daemon", GShadowKind, "daemon")).To(BeTrue())
+		Expect(match("gid<100 && kind=gshadow", GShadowKind, "wheel")).To(BeTrue())
+	})
+
+	It("combines the comparisons", func() {
+		Expect(match("uid=2 || member=wheel", UserKind, "foo")).To(BeTrue())
+		Expect(match("!(uid=2 || member=wheel)", UserKind, "foo")).To(BeFalse())
+		Expect(match("uid=2 || uid=1000 && shell=/bin/sh", UserKind, "foo")).To(BeFalse())
+		Expect(match("(uid=2 || uid=1000) && !shell=/bin/sh", UserKind, "foo")).To(BeTrue())
+	})
+
+	It("rejects invalid queries", func() {
+		for _, q := range []string{
+			"", "uid", "uid>=", "nope=1", "uid=1 &&", "(uid=1", "uid=1)",
+			`info="foo`, "shell~(", "=1",
+		} {
+			_, err := ParseQuery(q)
+			Expect(err).ShouldNot(BeNil(), q)
+		}
+
+		q, err := ParseQuery("uid>=1000")
+		Expect(err).Should(BeNil())
+		Expect(q.String()).To(Equal("uid>=1000"))
+	})
+
+	It("selects the entities of the filter", func() {
+		query, err := ParseQuery("member=wheel")
+		Expect(err).Should(BeNil())
+		f := EntitiesFilter{Query: query}
+
+		Expect(f.MatchEntity(store, UserKind, "foo")).To(BeTrue())
+		Expect(f.MatchEntity(store, UserKind, "daemon")).To(BeFalse())
+
+		exported := store.Export(ExportOptions{Kinds: []string{UserKind}, Filter: f})
+		Expect(exported).To(HaveLen(1))
+		Expect(EntityName(exported[0])).To(Equal("foo"))
+	})
+
+	Context("pruning", func() {
+		var root string
+		var files Files
+
+		BeforeEach(func() {
+			root, files = newTestRoot()
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(root)
+		})
+
+		It("prunes only the entities matching the query", func() {
+			specs := NewEntitiesStore()
+			Expect(specs.Load("../../testing/fixtures/specs")).Should(BeNil())
+			_, err := specs.Apply(files, false)
+			Expect(err).Should(BeNil())
+
+			delete(specs.Users, "web")
+			delete(specs.Shadows, "web")
+
+			query, err := ParseQuery("shell!=/bin/sh")
+			Expect(err).Should(BeNil())
+			filter := EntitiesFilter{Include: regexp.MustCompile("^web$"), Query: query}
+			results, err := specs.ApplyWithOptions(files, ApplyOptions{Prune: true, PruneFilter: filter})
+			Expect(err).Should(BeNil())
+			Expect(results).ToNot(ContainElement(HaveField("Action", ActionDeleted)))
+
+			filter.Query, err = ParseQuery("shell=/bin/sh")
+			Expect(err).Should(BeNil())
+			results, err = specs.ApplyWithOptions(files, ApplyOptions{Prune: true, PruneFilter: filter})
+			Expect(err).Should(BeNil())
+			Expect(results).To(ContainElements(
+				ApplyResult{Kind: ShadowKind, Name: "web", Action: ActionDeleted},
+				ApplyResult{Kind: UserKind, Name: "web", Action: ActionDeleted},
+			))
+		})
+	})
+})
@@ -19,7 +19,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -27,7 +26,6 @@ import (
 	"time"
 
 	"github.com/gofrs/flock"
-	"github.com/tredoe/osutil/user/crypt/sha512_crypt"
 
 	permbits "github.com/phayes/permbits"
 	"github.com/pkg/errors"
@@ -70,7 +68,17 @@ func parseLine(line string) (string, Shadow, error) {
 		return "", Shadow{}, errors.New("Unexpected number of fields in /etc/shadow: found " + strconv.Itoa(len(fs)))
 	}
 
-	return fs[0], Shadow{fs[0], fs[1], fs[2], fs[3], fs[4], fs[5], fs[6], fs[7], fs[8]}, nil
+	return fs[0], Shadow{
+		Username:       fs[0],
+		Password:       fs[1],
+		LastChanged:    fs[2],
+		MinimumChanged: fs[3],
+		MaximumChanged: fs[4],
+		Warn:           fs[5],
+		Inactive:       fs[6],
+		Expire:         fs[7],
+		Reserved:       fs[8],
+	}, nil
 }
 
 func copyBytes(x []byte) []byte {
@@ -80,15 +88,20 @@ func copyBytes(x []byte) []byte {
 }
 
 type Shadow struct {
-	Username       string `yaml:"username"`
-	Password       string `yaml:"password"`
-	LastChanged    string `yaml:"last_changed"`
-	MinimumChanged string `yaml:"minimum_changed"`
-	MaximumChanged string `yaml:"maximum_changed"`
-	Warn           string `yaml:"warn"`
-	Inactive       string `yaml:"inactive"`
-	Expire         string `yaml:"expire"`
-	Reserved       string `yaml:"reserved"`
+	Username       string `yaml:"username" json:"username"`
+	Password       string `yaml:"password" json:"password"`
+	LastChanged    string `yaml:"last_changed" json:"last_changed"`
+	MinimumChanged string `yaml:"minimum_changed" json:"minimum_changed"`
+	MaximumChanged string `yaml:"maximum_changed" json:"maximum_changed"`
+	Warn           string `yaml:"warn" json:"warn"`
+	Inactive       string `yaml:"inactive" json:"inactive"`
+	Expire         string `yaml:"expire" json:"expire"`
+	Reserved       string `yaml:"reserved" json:"reserved"`
+
+	PasswordSource `yaml:",inline" json:"-"`
+
+	// Policy applied to plaintext passwords before hashing
+	Policy *PasswordPolicy `yaml:"-" json:"-"`
 }
 
 func (u Shadow) GetKind() string { return ShadowKind }
@@ -116,58 +129,73 @@ func ShadowDefault(s string) string {
 	return s
 }
 
-const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-func randStringBytes(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
-	}
-	return string(b)
-}
-
-func encryptPassword(userPassword string) (string, error) {
-	salt := []byte(fmt.Sprintf("$6$%s", randStringBytes(8)))
-	c := sha512_crypt.New()
-	hash, err := c.Generate([]byte(userPassword), salt)
-	if err != nil {
-		return "", err
+// shadowToday returns the current days from 1970, as used in last_changed.
+func shadowToday() string {
+	now := time.Now()
+	days := now.Unix() / 24 / 60 / 60
+	// LastChanged field with value 0 has a special meaning, which is to change password on next login. We should never set it to zero.
+	// This avoids breaking ssh for example in systems that have no RTC clock or a broken one
+	if days == 0 {
+		days = 1
 	}
-	return string(hash), nil
+	return fmt.Sprintf("%d", days)
 }
 
-func (u Shadow) prepare() Shadow {
+func (u Shadow) prepare() (Shadow, error) {
 	if u.LastChanged == "now" {
 		// POST: Set in last_changed the current days from 1970
-		now := time.Now()
-		days := now.Unix() / 24 / 60 / 60
-		// LastChanged field with value 0 has a special meaning, which is to change password on next login. We should never set it to zero.
-		// This avoids breaking ssh for example in systems that have no RTC clock or a broken one
-		if days == 0 {
-			days = 1
-		}
-		u.LastChanged = fmt.Sprintf("%d", days)
+		u.LastChanged = shadowToday()
 	}
-	/*
-	 A password field which starts with an exclamation mark means
-	 that the password is locked. The remaining characters on the
-	 line represent the password field before the password was
-	 locked.
-
-	 Refer to crypt(3) for details on how this string is
-	 interpreted.
-
-	 If the password field contains some string that is not a
-	 valid result of crypt(3), for instance ! or *, the user will
-	 not be able to use a unix password to log in (but the user
-	 may log in the system by other means).
-	*/
-	if !strings.HasPrefix(u.Password, "$") && u.Password != "" &&
-		!strings.HasPrefix(u.Password, "!") && u.Password != "*" {
-		if pwd, err := encryptPassword(u.Password); err == nil {
-			u.Password = pwd
+	if u.PasswordSource.isSet() {
+		if u.Password != "" {
+			return u, errors.New("password can't be used together with a password source")
+		}
+		pwd, err := u.PasswordSource.resolve()
+		if err != nil {
+			return u, errors.Wrap(err, fmt.Sprintf("Failed resolving password of %s", u.Username))
 		}
+		u.Password = pwd
+		// Avoid this operation if prepare is called multiple times.
+		u.PasswordSource = PasswordSource{}
+	}
+
+	if err := u.Policy.Check(u.Username, u.Password); err != nil {
+		return u, err
+	}
+
+	pwd, err := hashPassword(u.Password)
+	if err != nil {
+		return u, errors.Wrap(err, "Failed hashing password")
+	}
+	u.Password = pwd
+
+	return u, nil
+}
+
+// ShadowUnset can be used as value of the aging fields to empty them
+// when the entity is applied, as fields left empty keep the current value.
+const ShadowUnset = "-1"
+
+func mergeShadowField(existing, value string) string {
+	switch value {
+	case ShadowUnset:
+		return ""
+	case "":
+		return existing
 	}
+	return value
+}
+
+// merge copies the values of existing for the aging fields that are empty
+// in u. The password of u is used as is, also if empty.
+func (u Shadow) merge(existing Shadow) Shadow {
+	u.LastChanged = mergeShadowField(existing.LastChanged, u.LastChanged)
+	u.MinimumChanged = mergeShadowField(existing.MinimumChanged, u.MinimumChanged)
+	u.MaximumChanged = mergeShadowField(existing.MaximumChanged, u.MaximumChanged)
+	u.Warn = mergeShadowField(existing.Warn, u.Warn)
+	u.Inactive = mergeShadowField(existing.Inactive, u.Inactive)
+	u.Expire = mergeShadowField(existing.Expire, u.Expire)
+	u.Reserved = mergeShadowField(existing.Reserved, u.Reserved)
 	return u
 }
 
@@ -242,7 +270,10 @@ func (u Shadow) Create(s string) error {
 		return errors.Wrap(err, "Failed locking file")
 	}
 
-	u = u.prepare()
+	u, err = u.prepare()
+	if err != nil {
+		return errors.Wrap(err, "Failed entity preparation")
+	}
 	current, err := ParseShadow(s)
 	if err != nil {
 		return errors.Wrap(err, "Failed parsing passwd")
@@ -250,6 +281,7 @@ func (u Shadow) Create(s string) error {
 	if _, ok := current[u.Username]; ok {
 		return errors.New("Entity already present")
 	}
+	u = u.merge(Shadow{})
 	permissions, err := permbits.Stat(s)
 	if err != nil {
 		return errors.Wrap(err, "Failed getting permissions")
@@ -268,86 +300,6 @@ func (u Shadow) Create(s string) error {
 }
 
 func (u Shadow) Apply(s string, safe bool) error {
-	s = ShadowDefault(s)
-
-	u = u.prepare()
-	current, err := ParseShadow(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed parsing passwd")
-	}
-	permissions, err := permbits.Stat(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
-	}
-	if existing, ok := current[u.Username]; ok {
-		// If we have some existing values in the current which are empty in the updated one, copy those
-		if existing.LastChanged != "" && u.LastChanged == "" {
-			u.LastChanged = existing.LastChanged
-		}
-		if existing.MinimumChanged != "" && u.MinimumChanged == "" {
-			u.MinimumChanged = existing.MinimumChanged
-		}
-		if existing.MaximumChanged != "" && u.MaximumChanged == "" {
-			u.MaximumChanged = existing.MaximumChanged
-		}
-		if existing.Warn != "" && u.Warn == "" {
-			u.Warn = existing.Warn
-		}
-		if existing.Inactive != "" && u.Inactive == "" {
-			u.Inactive = existing.Inactive
-		}
-		if existing.Expire != "" && u.Expire == "" {
-			u.Expire = existing.Expire
-		}
-		if existing.Reserved != "" && u.Reserved == "" {
-			u.Reserved = existing.Reserved
-		}
-
-		d, err := RetryForDuration()
-		if err != nil {
-			return errors.Wrap(err, "Failed getting delay")
-		}
-
-		baseName := filepath.Base(s)
-		if _, ok := os.Stat("/run/lock/"); os.IsNotExist(ok) {
-			_ = os.Mkdir("/run/lock/", 0755)
-		}
-		fileLock := flock.New(fmt.Sprintf("/run/lock/%s.lock", baseName))
-		defer os.Remove(fileLock.Path())
-		defer fileLock.Close()
-		lockCtx, cancel := context.WithTimeout(context.Background(), d)
-		defer cancel()
-		i, err := RetryIntervalDuration()
-		if err != nil {
-			return errors.Wrap(err, "Failed getting interval")
-		}
-		locked, err := fileLock.TryLockContext(lockCtx, i)
-		if err != nil || !locked {
-			return errors.Wrap(err, "Failed locking file")
-		}
-
-		input, err := os.ReadFile(s)
-		if err != nil {
-			return errors.Wrap(err, "Could not read input file")
-		}
-
-		lines := strings.Split(string(input), "\n")
-
-		for i, line := range lines {
-			if entityIdentifier(line) == u.Username && !safe {
-				lines[i] = u.String()
-			}
-		}
-		output := strings.Join(lines, "\n")
-		err = os.WriteFile(s, []byte(output), os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not write")
-		}
-
-	} else {
-		// Add it
-		return u.Create(s)
-	}
-
-	return nil
+	_, err := ApplyEntity(u, s, safe)
+	return err
 }
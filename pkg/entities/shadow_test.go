@@ -18,6 +18,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gofrs/flock"
@@ -142,6 +143,53 @@ uucp:*:9797:0:::::
 `))
 		})
 
+		It("Keeps unspecified fields", func() {
+			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
+			if err != nil {
+				fmt.Println("Cannot create temporary file", err)
+			}
+
+			// cleaning up by removing the file
+			defer os.Remove(tmpFile.Name())
+
+			_, err = copy("../../testing/fixtures/shadow/shadow", tmpFile.Name())
+			Expect(err).Should(BeNil())
+
+			s := Shadow{Username: "halt", Password: "*", MaximumChanged: "90", Expire: "100"}
+			Expect(s.Apply(tmpFile.Name(), false)).Should(BeNil())
+
+			s = Shadow{Username: "halt", Password: "*", MinimumChanged: ShadowUnset, Warn: "7"}
+			Expect(s.Apply(tmpFile.Name(), false)).Should(BeNil())
+
+			dat, err := os.ReadFile(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(HavePrefix("halt:*:9797::90:7::100:\n"))
+		})
+
+		It("sets the password of the spec also if empty", func() {
+			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
+			if err != nil {
+				fmt.Println("Cannot create temporary file", err)
+			}
+
+			// cleaning up by removing the file
+			defer os.Remove(tmpFile.Name())
+
+			_, err = copy("../../testing/fixtures/shadow/shadow", tmpFile.Name())
+			Expect(err).Should(BeNil())
+
+			s := Shadow{Username: "halt", Password: "$6$salt$hash"}
+			Expect(s.Apply(tmpFile.Name(), false)).Should(BeNil())
+
+			// Only the aging fields left empty keep the current values
+			s = Shadow{Username: "halt", MaximumChanged: "90"}
+			Expect(s.Apply(tmpFile.Name(), false)).Should(BeNil())
+
+			dat, err := os.ReadFile(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(HavePrefix("halt::9797:0:90::::\n"))
+		})
+
 		It("works with locks", func() {
 			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
 			if err != nil {
@@ -226,4 +274,142 @@ uucp:*:9797:0:::::
 
 	})
 
+	Context("Password sources", func() {
+		p := &Parser{}
+
+		applyShadow := func(s Shadow) (Shadow, error) {
+			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
+			Expect(err).Should(BeNil())
+			defer os.Remove(tmpFile.Name())
+
+			err = s.Apply(tmpFile.Name(), false)
+			if err != nil {
+				return Shadow{}, err
+			}
+
+			current, err := ParseShadow(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			return current[s.Username], nil
+		}
+
+		It("reads the password from the environment", func() {
+			os.Setenv("ENTITIES_TEST_PASSWORD", "secret")
+			defer os.Unsetenv("ENTITIES_TEST_PASSWORD")
+
+			entity, err := p.ReadEntity("../../testing/fixtures/shadow/source.yaml")
+			Expect(err).Should(BeNil())
+			Expect(entity.(Shadow).PasswordEnv).Should(Equal("ENTITIES_TEST_PASSWORD"))
+
+			s, err := applyShadow(entity.(Shadow))
+			Expect(err).Should(BeNil())
+			Expect(PasswordMatch(s.Password, "secret")).To(BeTrue())
+		})
+
+		It("reads the password from a file and from a command", func() {
+			pwdFile, err := os.CreateTemp(os.TempDir(), "pwd-")
+			Expect(err).Should(BeNil())
+			defer os.Remove(pwdFile.Name())
+			pwdFile.WriteString("fromfile\n")
+			pwdFile.Close()
+
+			s, err := applyShadow(Shadow{
+				Username:       "foo",
+				PasswordSource: PasswordSource{PasswordFile: pwdFile.Name()},
+			})
+			Expect(err).Should(BeNil())
+			Expect(PasswordMatch(s.Password, "fromfile")).To(BeTrue())
+
+			s, err = applyShadow(Shadow{
+				Username:       "foo",
+				PasswordSource: PasswordSource{PasswordCommand: "echo fromcommand"},
+			})
+			Expect(err).Should(BeNil())
+			Expect(PasswordMatch(s.Password, "fromcommand")).To(BeTrue())
+		})
+
+		It("hashes the password of the users", func() {
+			pwdFile, err := os.CreateTemp(os.TempDir(), "pwd-")
+			Expect(err).Should(BeNil())
+			defer os.Remove(pwdFile.Name())
+			pwdFile.WriteString("s3cret\n")
+			pwdFile.Close()
+
+			tmpFile, err := os.CreateTemp(os.TempDir(), "pre-")
+			Expect(err).Should(BeNil())
+			defer os.Remove(tmpFile.Name())
+
+			u := UserPasswd{
+				Username:       "foo",
+				Uid:            1001,
+				Gid:            1001,
+				Homedir:        "/home/foo",
+				Shell:          "/bin/sh",
+				PasswordSource: PasswordSource{PasswordFile: pwdFile.Name()},
+			}
+			Expect(u.Apply(tmpFile.Name(), false)).Should(BeNil())
+
+			current, err := ParseUser(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			Expect(current["foo"].Password).To(HavePrefix("$"))
+			Expect(PasswordMatch(current["foo"].Password, "s3cret")).To(BeTrue())
+
+			res, err := ApplyEntity(u, tmpFile.Name(), false)
+			Expect(err).Should(BeNil())
+			Expect(res.Action).To(Equal(ActionUnchanged))
+		})
+
+		It("generates the password only once", func() {
+			dir, err := os.MkdirTemp(os.TempDir(), "gen-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(dir)
+			output := filepath.Join(dir, "foo.pwd")
+
+			s, err := applyShadow(Shadow{
+				Username:       "foo",
+				PasswordSource: PasswordSource{Generate: true, GenerateOutput: output},
+			})
+			Expect(err).Should(BeNil())
+
+			info, err := os.Stat(output)
+			Expect(err).Should(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			generated, err := os.ReadFile(output)
+			Expect(err).Should(BeNil())
+			Expect(PasswordMatch(s.Password, strings.TrimSpace(string(generated)))).To(BeTrue())
+
+			s, err = applyShadow(Shadow{
+				Username:       "foo",
+				PasswordSource: PasswordSource{Generate: true, GenerateOutput: output},
+			})
+			Expect(err).Should(BeNil())
+			Expect(PasswordMatch(s.Password, strings.TrimSpace(string(generated)))).To(BeTrue())
+		})
+
+		It("doesn't leak the password in errors", func() {
+			_, err := applyShadow(Shadow{
+				Username:       "foo",
+				PasswordSource: PasswordSource{PasswordCommand: "echo leaked; exit 1"},
+			})
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).ToNot(ContainSubstring("leaked"))
+
+			_, err = applyShadow(Shadow{
+				Username:       "foo",
+				Password:       "bar",
+				PasswordSource: PasswordSource{PasswordEnv: "FOO"},
+			})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("redacts passwords", func() {
+			Expect(RedactPassword("$6$salt$hash")).To(Equal(RedactedPassword))
+			Expect(RedactPassword("!$6$salt$hash")).To(Equal("!" + RedactedPassword))
+			Expect(RedactPassword("!!")).To(Equal("!!"))
+			Expect(RedactPassword("x")).To(Equal("x"))
+			Expect(RedactPassword("*")).To(Equal("*"))
+			Expect(RedactEntity(Shadow{Username: "foo", Password: "$1$a$b"})).
+				To(Equal(Shadow{Username: "foo", Password: RedactedPassword}))
+		})
+	})
+
 })
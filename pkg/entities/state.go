@@ -0,0 +1,247 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+func StateDefault(s string) string {
+	if s == "" {
+		// Check environment override before to use default.
+		s = os.Getenv(ENTITY_ENV_DEF_STATE)
+		if s == "" {
+			s = "/var/lib/entities/state.json"
+		}
+	}
+	return s
+}
+
+// StateEntry records an entity created or applied by entities.
+type StateEntry struct {
+	Kind string `json:"kind" yaml:"kind"`
+	Name string `json:"name" yaml:"name"`
+	// Spec file the entity was applied from, if any
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	// Hash of the line written in the identity file
+	Hash string `json:"hash" yaml:"hash"`
+	// Uid or gid written, for users and groups
+	ID      *int      `json:"id,omitempty" yaml:"id,omitempty"`
+	Updated time.Time `json:"updated" yaml:"updated"`
+}
+
+// State is the database of the entities owned by entities. Only the
+// owned entities are removed by delete and prune.
+type State struct {
+	Entities map[string]StateEntry `json:"entities"`
+
+	path string
+	lock *flock.Flock
+}
+
+func stateKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+func lineHash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ReadState parses the state file. A missing file is an empty state.
+func ReadState(path string) (*State, error) {
+	s := &State{Entities: make(map[string]StateEntry), path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Failed reading state file")
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrap(err, "Failed parsing state file")
+	}
+	if s.Entities == nil {
+		s.Entities = make(map[string]StateEntry)
+	}
+
+	return s, nil
+}
+
+// OpenState locks and reads the state file. The lock is released by Close.
+func OpenState(path string) (*State, error) {
+	fileLock, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := ReadState(path)
+	if err != nil {
+		unlockFile(fileLock)
+		return nil, err
+	}
+	s.lock = fileLock
+
+	return s, nil
+}
+
+// Close releases the lock of the state file.
+func (s *State) Close() {
+	if s.lock != nil {
+		unlockFile(s.lock)
+		s.lock = nil
+	}
+}
+
+// Get returns the entry of the entity.
+func (s *State) Get(kind, name string) (StateEntry, bool) {
+	e, ok := s.Entities[stateKey(kind, name)]
+	return e, ok
+}
+
+// Owns reports whether the entity was created or applied by entities.
+func (s *State) Owns(kind, name string) bool {
+	_, ok := s.Get(kind, name)
+	return ok
+}
+
+// List returns the entries sorted by kind and name.
+func (s *State) List() []StateEntry {
+	ans := []StateEntry{}
+	for _, e := range s.Entities {
+		ans = append(ans, e)
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		if ans[i].Kind != ans[j].Kind {
+			return ans[i].Kind < ans[j].Kind
+		}
+		return ans[i].Name < ans[j].Name
+	})
+	return ans
+}
+
+// lineID returns the uid or the gid of a user or group line.
+func lineID(kind, line string) *int {
+	if kind != UserKind && kind != GroupKind {
+		return nil
+	}
+	fs := strings.Split(line, ":")
+	if len(fs) < 3 {
+		return nil
+	}
+	id, err := strconv.Atoi(fs[2])
+	if err != nil {
+		return nil
+	}
+	return &id
+}
+
+// record updates the entry of the entity with the line written. It
+// returns false if the entry didn't change.
+func (s *State) record(kind, name, source, line string, now time.Time) bool {
+	key := stateKey(kind, name)
+	hash := lineHash(line)
+	id := lineID(kind, line)
+
+	e, ok := s.Entities[key]
+	if ok && e.Hash == hash && (source == "" || e.Source == source) &&
+		(id == nil || e.ID != nil) {
+		return false
+	}
+	if source == "" {
+		source = e.Source
+	}
+
+	s.Entities[key] = StateEntry{
+		Kind:    kind,
+		Name:    name,
+		Source:  source,
+		Hash:    hash,
+		ID:      id,
+		Updated: now,
+	}
+	return true
+}
+
+// Forget removes the entry of the entity. It returns false if the entity
+// was not in the state.
+func (s *State) Forget(kind, name string) bool {
+	key := stateKey(kind, name)
+	if _, ok := s.Entities[key]; !ok {
+		return false
+	}
+	delete(s.Entities, key)
+	return true
+}
+
+// Save writes the state file with 0600 permissions.
+func (s *State) Save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.Wrap(err, "Failed creating state directory")
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed encoding state")
+	}
+
+	return writeFileAtomic(s.path, append(data, '\n'), 0600)
+}
+
+// Status of an owned entity compared with the identity files
+const (
+	StateOK       = "ok"
+	StateModified = "modified"
+	StateMissing  = "missing"
+)
+
+// Status returns whether the entity recorded in the entry is still present
+// in the identity files and unchanged since entities wrote it.
+func (e StateEntry) Status(f Files) (string, error) {
+	path := f.Path(e.Kind)
+	if path == "" {
+		return "", errors.New("Invalid entity kind " + e.Kind)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return StateMissing, nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "Could not read input file")
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if entityIdentifier(line) != e.Name {
+			continue
+		}
+		if lineHash(line) == e.Hash {
+			return StateOK, nil
+		}
+		return StateModified, nil
+	}
+
+	return StateMissing, nil
+}
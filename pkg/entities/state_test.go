@@ -0,0 +1,178 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("State", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("records the applied entities", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		_, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		Expect(files.State).To(Equal(filepath.Join(root, "/var/lib/entities/state.json")))
+		info, err := os.Stat(files.State)
+		Expect(err).Should(BeNil())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		st, err := ReadState(files.State)
+		Expect(err).Should(BeNil())
+		Expect(st.List()).To(HaveLen(4))
+
+		e, ok := st.Get(UserKind, "web")
+		Expect(ok).To(BeTrue())
+		abs, _ := filepath.Abs("../../testing/fixtures/specs/user.yaml")
+		Expect(e.Source).To(Equal(abs))
+		Expect(e.Hash).To(HavePrefix("sha256:"))
+		Expect(e.Status(files)).To(Equal(StateOK))
+
+		Expect(st.Owns(UserKind, "root")).To(BeFalse())
+	})
+
+	It("doesn't record the entities applied without a store", func() {
+		for env, path := range map[string]string{
+			ENTITY_ENV_DEF_PASSWD:  files.Passwd,
+			ENTITY_ENV_DEF_SHADOW:  files.Shadow,
+			ENTITY_ENV_DEF_GROUPS:  files.Group,
+			ENTITY_ENV_DEF_GSHADOW: files.GShadow,
+			ENTITY_ENV_DEF_STATE:   files.State,
+		} {
+			defer os.Unsetenv(env)
+			os.Setenv(env, path)
+		}
+
+		gid := 1500
+		Expect(Group{Name: "foo", Password: "x", Gid: &gid}.Apply("", false)).Should(BeNil())
+		Expect(UserPasswd{Username: "foo", Password: "x", Uid: 1500, Gid: 1500,
+			Homedir: "/home/foo", Shell: "/bin/sh"}.Apply("", false)).Should(BeNil())
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(groups).To(HaveKey("foo"))
+		_, err = os.Stat(files.State)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("detects entities modified outside entities", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		_, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		_, err = ApplyEntity(UserPasswd{
+			Username: "web", Password: "x", Uid: 1000, Gid: 1000,
+			Info: "Changed", Homedir: "/srv/web", Shell: "/bin/sh",
+		}, files.Passwd, false)
+		Expect(err).Should(BeNil())
+
+		st, err := ReadState(files.State)
+		Expect(err).Should(BeNil())
+		e, _ := st.Get(UserKind, "web")
+		Expect(e.Status(files)).To(Equal(StateModified))
+		e, _ = st.Get(GroupKind, "webgrp")
+		Expect(e.Status(files)).To(Equal(StateOK))
+	})
+
+	It("deletes only the owned entities", func() {
+		t := NewTransaction(files)
+		Expect(t.Delete(UserPasswd{Username: "bin"})).ToNot(BeNil())
+		t.Close()
+
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		_, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		t = NewTransaction(files)
+		Expect(t.Delete(UserPasswd{Username: "web"})).Should(BeNil())
+		Expect(t.Commit()).Should(BeNil())
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users).ToNot(HaveKey("web"))
+
+		st, err := ReadState(files.State)
+		Expect(err).Should(BeNil())
+		Expect(st.Owns(UserKind, "web")).To(BeFalse())
+		Expect(st.Owns(ShadowKind, "web")).To(BeTrue())
+	})
+
+	It("prunes only the owned entities", func() {
+		store := NewEntitiesStore()
+		store.AddUser(UserPasswd{Username: "foo", Password: "x", Uid: 1500, Gid: 100})
+		_, err := ApplyEntity(UserPasswd{Username: "manual", Password: "x", Uid: 1600, Gid: 100}, files.Passwd, false)
+		Expect(err).Should(BeNil())
+		_, err = store.Apply(files, false)
+		Expect(err).Should(BeNil())
+
+		results, err := NewEntitiesStore().ApplyWithOptions(files, ApplyOptions{
+			Prune:       true,
+			PruneFilter: EntitiesFilter{MinID: 1000},
+		})
+		Expect(err).Should(BeNil())
+		Expect(results).To(Equal([]ApplyResult{
+			{Kind: UserKind, Name: "foo", Action: ActionDeleted},
+		}))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users).To(HaveKey("manual"))
+	})
+
+	It("removes nothing without a state unless forced", func() {
+		files.State = ""
+		_, err := ApplyEntity(UserPasswd{Username: "manual", Password: "x", Uid: 1600, Gid: 100}, files.Passwd, false)
+		Expect(err).Should(BeNil())
+
+		t := NewTransaction(files)
+		Expect(t.Delete(UserPasswd{Username: "manual"})).ToNot(BeNil())
+		t.Close()
+
+		opts := ApplyOptions{Prune: true, PruneFilter: EntitiesFilter{MinID: 1000}}
+		_, err = NewEntitiesStore().ApplyWithOptions(files, opts)
+		Expect(err).ToNot(BeNil())
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users).To(HaveKey("manual"))
+
+		opts.Force = true
+		results, err := NewEntitiesStore().ApplyWithOptions(files, opts)
+		Expect(err).Should(BeNil())
+		Expect(results).To(Equal([]ApplyResult{
+			{Kind: UserKind, Name: "manual", Action: ActionDeleted},
+		}))
+	})
+})
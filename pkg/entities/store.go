@@ -17,6 +17,7 @@ package entities
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -27,6 +28,9 @@ type EntitiesStore struct {
 	Groups   map[string]Group
 	Shadows  map[string]Shadow
 	GShadows map[string]GShadow
+
+	// Spec files of the entities loaded from files
+	sources map[string]string
 }
 
 func NewEntitiesStore() *EntitiesStore {
@@ -46,27 +50,174 @@ func (s *EntitiesStore) Load(dir string) error {
 		return err
 	}
 
-	p := &Parser{}
+	// The policy is checked also if no shadow spec uses it
+	if _, err := LoadPasswordPolicy(dir); err != nil {
+		return errors.New("Failed loading the password policy: " + err.Error())
+	}
 
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
 
-		if !regexConfs.MatchString(file.Name()) {
+		if !regexConfs.MatchString(file.Name()) || file.Name() == PasswordPolicyFile {
 			continue
 		}
 
-		entity, err := p.ReadEntity(filepath.Join(dir, file.Name()))
-		if err == nil {
-			s.AddEntity(entity)
+		// A broken spec is an error, not to prune what it defines
+		path := filepath.Join(dir, file.Name())
+		if err := s.LoadFile(path); err != nil {
+			return errors.New("Failed loading " + path + ": " + err.Error())
 		}
+	}
 
+	return nil
+}
+
+// LoadFile adds the entities defined in the given spec file.
+func (s *EntitiesStore) LoadFile(file string) error {
+	p := &Parser{}
+
+	entities, err := p.ReadEntities(file)
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		if err := s.AddEntity(entity); err != nil {
+			return err
+		}
+		s.setSource(entity, file)
 	}
 
 	return nil
 }
 
+func (s *EntitiesStore) setSource(e Entity, file string) {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if s.sources == nil {
+		s.sources = make(map[string]string)
+	}
+	s.sources[stateKey(e.GetKind(), EntityName(e))] = file
+}
+
+// Source returns the spec file the entity was loaded from, if any.
+func (s *EntitiesStore) Source(e Entity) string {
+	return s.sources[stateKey(e.GetKind(), EntityName(e))]
+}
+
+// Entities returns the entities of the store in the order they have to be
+// applied: groups before the users that reference them and entities before
+// their shadow entries. Entities of the same kind are sorted by name.
+func (s *EntitiesStore) Entities() []Entity {
+	ans := []Entity{}
+
+	for _, kind := range transactionKinds {
+		for _, name := range s.names(kind) {
+			ans = append(ans, s.get(kind, name))
+		}
+	}
+
+	return ans
+}
+
+// Actions reported in ApplyResult
+const (
+	ActionCreated   = "created"
+	ActionUpdated   = "updated"
+	ActionUnchanged = "unchanged"
+	ActionDeleted   = "deleted"
+)
+
+// ApplyResult describes the action taken applying an entity. Changes lists
+// the fields modified by an update.
+type ApplyResult struct {
+	Kind    string   `json:"kind" yaml:"kind"`
+	Name    string   `json:"name" yaml:"name"`
+	Action  string   `json:"action" yaml:"action"`
+	Changes []string `json:"changes,omitempty" yaml:"changes,omitempty"`
+}
+
+// Changed reports whether the entity was created, updated or deleted.
+func (r ApplyResult) Changed() bool {
+	return r.Action != ActionUnchanged
+}
+
+// ApplyOptions defines how the entities of a store are applied.
+type ApplyOptions struct {
+	// Don't override existing entities, as Entity.Apply
+	Safe bool
+	// Remove the entities of the identity files missing in the store and
+	// selected by PruneFilter
+	Prune       bool
+	PruneFilter EntitiesFilter
+	// Prune also without a state, removing all the entities selected
+	Force bool
+}
+
+// Apply applies all the entities of the store in a single transaction,
+// writing each changed file once. Nothing is written if an entity fails or
+// if nothing changed. The entities are recorded in the state of f.
+func (s *EntitiesStore) Apply(f Files, safe bool) ([]ApplyResult, error) {
+	return s.ApplyWithOptions(f, ApplyOptions{Safe: safe})
+}
+
+// ApplyWithOptions is Apply with the given options.
+func (s *EntitiesStore) ApplyWithOptions(f Files, opts ApplyOptions) ([]ApplyResult, error) {
+	t := NewTransaction(f)
+	defer t.Close()
+
+	results, err := s.apply(t, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, t.Commit()
+}
+
+// Plan returns the changes Apply would do on the identity files, without
+// writing them.
+func (s *EntitiesStore) Plan(f Files, safe bool) ([]FileChange, error) {
+	return s.PlanWithOptions(f, ApplyOptions{Safe: safe})
+}
+
+// PlanWithOptions is Plan with the given options.
+func (s *EntitiesStore) PlanWithOptions(f Files, opts ApplyOptions) ([]FileChange, error) {
+	return Plan(f, func(t *Transaction) error {
+		_, err := s.apply(t, opts)
+		return err
+	})
+}
+
+func (s *EntitiesStore) apply(t *Transaction, opts ApplyOptions) ([]ApplyResult, error) {
+	t.Track = true
+	t.Force = opts.Force
+
+	results := []ApplyResult{}
+	for _, e := range s.Entities() {
+		if src := s.Source(e); src != "" {
+			t.SetSource(e, src)
+		}
+		res, err := t.Apply(e, opts.Safe)
+		if err != nil {
+			return nil, fmt.Errorf("Failed applying %s %s: %w", e.GetKind(), EntityName(e), err)
+		}
+		results = append(results, res)
+	}
+
+	if opts.Prune {
+		pruned, err := t.Prune(s, opts.PruneFilter)
+		if err != nil {
+			return nil, fmt.Errorf("Failed pruning entities: %w", err)
+		}
+		results = append(results, pruned...)
+	}
+
+	return results, nil
+}
+
 func (s *EntitiesStore) AddEntity(e Entity) error {
 	var err error
 	switch e.GetKind() {
@@ -0,0 +1,156 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EntitiesStore", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("orders the entities", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+
+		kinds := []string{}
+		for _, e := range store.Entities() {
+			kinds = append(kinds, e.GetKind())
+		}
+		Expect(kinds).To(Equal([]string{GroupKind, GShadowKind, UserKind, ShadowKind}))
+	})
+
+	It("fails loading a directory with a broken spec", func() {
+		dir := filepath.Join(root, "specs")
+		Expect(os.MkdirAll(dir, 0755)).Should(BeNil())
+		writeFile(filepath.Join(dir, "user.yaml"), "kind: user\nusername: foo\nuid: 1000\n")
+		writeFile(filepath.Join(dir, "broken.yaml"), "kind: user\nusername: [\n")
+
+		store := NewEntitiesStore()
+		Expect(store.Load(dir)).ShouldNot(BeNil())
+
+		Expect(os.Remove(filepath.Join(dir, "broken.yaml"))).Should(BeNil())
+		writeFile(filepath.Join(dir, PasswordPolicyFile), "min_length: [\n")
+		Expect(NewEntitiesStore().Load(dir)).ShouldNot(BeNil())
+
+		Expect(os.Remove(filepath.Join(dir, PasswordPolicyFile))).Should(BeNil())
+		Expect(NewEntitiesStore().Load(dir)).Should(BeNil())
+	})
+
+	It("applies a specs directory", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+
+		results, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+		Expect(results).To(HaveLen(4))
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(*groups["webgrp"].Gid).To(Equal(1000))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users["web"].Uid).To(Equal(1000))
+		Expect(users["web"].Gid).To(Equal(1000))
+
+		shadows, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(PasswordMatch(shadows["web"].Password, "Secret")).To(BeTrue())
+
+		gshadows, err := ParseGShadow(files.GShadow)
+		Expect(err).Should(BeNil())
+		Expect(gshadows["webgrp"].Members).To(Equal("web"))
+	})
+
+	It("doesn't write anything if an entity fails", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+		u := store.Users["web"]
+		u.Group = "missing"
+		store.AddUser(u)
+
+		before, err := os.ReadFile(files.Group)
+		Expect(err).Should(BeNil())
+
+		_, err = store.Apply(files, false)
+		Expect(err).ToNot(BeNil())
+
+		after, err := os.ReadFile(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(after).To(Equal(before))
+	})
+
+	It("reports the action taken and doesn't rewrite unchanged files", func() {
+		store := NewEntitiesStore()
+		Expect(store.Load("../../testing/fixtures/specs")).Should(BeNil())
+
+		results, err := store.Apply(files, false)
+		Expect(err).Should(BeNil())
+		for _, r := range results {
+			Expect(r.Action).To(Equal(ActionCreated))
+		}
+
+		before, err := os.Stat(files.Shadow)
+		Expect(err).Should(BeNil())
+
+		results, err = store.Apply(files, false)
+		Expect(err).Should(BeNil())
+		for _, r := range results {
+			Expect(r.Action).To(Equal(ActionUnchanged))
+			Expect(r.Changed()).To(BeFalse())
+		}
+
+		after, err := os.Stat(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(os.SameFile(before, after)).To(BeTrue())
+	})
+
+	It("reports the fields updated", func() {
+		res, err := ApplyEntity(Shadow{Username: "lp", Password: "*", Warn: "7"}, files.Shadow, false)
+		Expect(err).Should(BeNil())
+		Expect(res).To(Equal(ApplyResult{
+			Kind:    ShadowKind,
+			Name:    "lp",
+			Action:  ActionUpdated,
+			Changes: []string{"warn"},
+		}))
+	})
+
+	It("doesn't override ids in safe mode", func() {
+		store := NewEntitiesStore()
+		store.AddUser(UserPasswd{Username: "foo", Password: "x", Uid: 0, Gid: 0})
+
+		_, err := store.Apply(files, true)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("Uid 0 is already used on user root"))
+	})
+})
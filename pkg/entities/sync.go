@@ -0,0 +1,186 @@
+/*
+Copyright © 2021 Daniele Rondina <geaaru@sabayon.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"strings"
+)
+
+// Sync moves the password hashes of passwd and group in the shadow files,
+// adds the missing shadow and gshadow entries, locked, and removes the
+// entries of users and groups that don't exist, as pwconv and grpconv do.
+func Sync(f Files) ([]ApplyResult, error) {
+	t := NewTransaction(f)
+	defer t.Close()
+
+	results, err := t.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	return results, t.Commit()
+}
+
+// Unsync moves the password hashes of the shadow files back in passwd and
+// group and removes all the shadow and gshadow entries, as pwunconv and
+// grpunconv do. The aging of the passwords is lost.
+func Unsync(f Files) ([]ApplyResult, error) {
+	t := NewTransaction(f)
+	defer t.Close()
+
+	results, err := t.Unsync()
+	if err != nil {
+		return nil, err
+	}
+
+	return results, t.Commit()
+}
+
+// Sync is the Sync function on the databases of the transaction.
+func (t *Transaction) Sync() ([]ApplyResult, error) {
+	results := []ApplyResult{}
+	for _, kinds := range [][2]string{{UserKind, ShadowKind}, {GroupKind, GShadowKind}} {
+		res, err := t.syncShadow(kinds[0], kinds[1])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// Unsync is the Unsync function on the databases of the transaction.
+func (t *Transaction) Unsync() ([]ApplyResult, error) {
+	results := []ApplyResult{}
+	for _, kinds := range [][2]string{{UserKind, ShadowKind}, {GroupKind, GShadowKind}} {
+		res, err := t.unsyncShadow(kinds[0], kinds[1])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// newShadowLine returns the shadow or gshadow line of an entity without it.
+func newShadowLine(kind, name, password string, fs []string) string {
+	if kind == ShadowKind {
+		return strings.Join([]string{name, password, shadowToday(), "", "", "", "", "", ""}, ":")
+	}
+	return strings.Join([]string{name, password, "", fs[3]}, ":")
+}
+
+func (t *Transaction) syncShadow(kind, shadowKind string) ([]ApplyResult, error) {
+	d, err := t.db(kind)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := t.db(shadowKind)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ApplyResult{}
+	names := make(map[string]bool)
+	for _, line := range d.lines {
+		// The malformed lines are skipped, but their shadow entries kept
+		names[entityIdentifier(line)] = true
+		fs := strings.Split(line, ":")
+		if len(fs) != databaseFields[kind] {
+			continue
+		}
+		name, password := fs[0], fs[1]
+
+		// The password moved in the shadow file, or locked if there isn't one
+		moved := password != "x"
+		if !moved {
+			password = "!"
+		}
+
+		if sline, ok := sd.get(name); !ok {
+			sd.set(name, newShadowLine(shadowKind, name, password, fs))
+			results = append(results, ApplyResult{Kind: shadowKind, Name: name, Action: ActionCreated})
+		} else if moved {
+			sfs := strings.Split(sline, ":")
+			if len(sfs) > 1 {
+				sfs[1] = password
+				sd.set(name, strings.Join(sfs, ":"))
+				results = append(results, ApplyResult{
+					Kind: shadowKind, Name: name, Action: ActionUpdated, Changes: []string{"password"},
+				})
+			}
+		}
+
+		if moved {
+			fs[1] = "x"
+			d.set(name, strings.Join(fs, ":"))
+			results = append(results, ApplyResult{
+				Kind: kind, Name: name, Action: ActionUpdated, Changes: []string{"password"},
+			})
+		}
+	}
+
+	orphans := []string{}
+	for _, line := range sd.lines {
+		if name := entityIdentifier(line); !names[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	for _, name := range orphans {
+		sd.remove(name)
+		results = append(results, ApplyResult{Kind: shadowKind, Name: name, Action: ActionDeleted})
+	}
+
+	return results, t.sortAs(kind, shadowKind)
+}
+
+func (t *Transaction) unsyncShadow(kind, shadowKind string) ([]ApplyResult, error) {
+	d, err := t.db(kind)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := t.db(shadowKind)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ApplyResult{}
+	for _, sline := range sd.lines {
+		sfs := strings.Split(sline, ":")
+		if len(sfs) < 2 {
+			continue
+		}
+		name := sfs[0]
+
+		if line, ok := d.get(name); ok {
+			fs := strings.Split(line, ":")
+			if len(fs) == databaseFields[kind] && fs[1] != sfs[1] {
+				fs[1] = sfs[1]
+				d.set(name, strings.Join(fs, ":"))
+				results = append(results, ApplyResult{
+					Kind: kind, Name: name, Action: ActionUpdated, Changes: []string{"password"},
+				})
+			}
+		}
+
+		results = append(results, ApplyResult{Kind: shadowKind, Name: name, Action: ActionDeleted})
+	}
+
+	if len(sd.lines) > 0 {
+		sd.lines = []string{}
+		sd.changed = true
+	}
+
+	return results, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sync", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newEmptyRoot()
+		writeFile(files.Passwd, "foo:$6$a$hash:1000:1000::/home/foo:/bin/sh\nbar:x:1001:1000::/home/bar:/bin/sh\n")
+		writeFile(files.Shadow, "old:!:19000::::::\nbar:$6$b$hash:19000:0:99999:7:::\n")
+		writeFile(files.Group, "foo:x:1000:bar\nweb:$6$c$hash:1001:\n")
+		writeFile(files.GShadow, "old:!::\n")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("moves the hashes in the shadow files", func() {
+		results, err := Sync(files)
+		Expect(err).Should(BeNil())
+		Expect(results).To(ContainElement(ApplyResult{Kind: ShadowKind, Name: "old", Action: ActionDeleted}))
+		Expect(results).To(ContainElement(ApplyResult{Kind: GShadowKind, Name: "foo", Action: ActionCreated}))
+
+		Expect(readFile(files.Passwd)).To(Equal("foo:x:1000:1000::/home/foo:/bin/sh\nbar:x:1001:1000::/home/bar:/bin/sh\n"))
+		shadow := readFile(files.Shadow)
+		Expect(shadow).To(MatchRegexp(`^foo:\$6\$a\$hash:[0-9]+::::::\nbar:\$6\$b\$hash:19000:0:99999:7:::\n$`))
+		Expect(readFile(files.Group)).To(Equal("foo:x:1000:bar\nweb:x:1001:\n"))
+		Expect(readFile(files.GShadow)).To(Equal("foo:!::bar\nweb:$6$c$hash::\n"))
+
+		results, err = Sync(files)
+		Expect(err).Should(BeNil())
+		Expect(results).To(BeEmpty())
+	})
+
+	It("keeps the shadow entries of the malformed lines", func() {
+		writeFile(files.Passwd, "foo:x:1000:1000::/home/foo:/bin/sh\nbar:x:1001:1000\n")
+		writeFile(files.Shadow, "foo:!:19000::::::\nbar:$6$b$hash:19000:0:99999:7:::\n")
+
+		results, err := Sync(files)
+		Expect(err).Should(BeNil())
+		Expect(results).ToNot(ContainElement(ApplyResult{Kind: ShadowKind, Name: "bar", Action: ActionDeleted}))
+
+		Expect(readFile(files.Passwd)).To(Equal("foo:x:1000:1000::/home/foo:/bin/sh\nbar:x:1001:1000\n"))
+		Expect(readFile(files.Shadow)).To(Equal("foo:!:19000::::::\nbar:$6$b$hash:19000:0:99999:7:::\n"))
+	})
+
+	It("moves the hashes back with Unsync", func() {
+		_, err := Sync(files)
+		Expect(err).Should(BeNil())
+
+		_, err = Unsync(files)
+		Expect(err).Should(BeNil())
+
+		Expect(readFile(files.Passwd)).To(Equal("foo:$6$a$hash:1000:1000::/home/foo:/bin/sh\nbar:$6$b$hash:1001:1000::/home/bar:/bin/sh\n"))
+		Expect(readFile(files.Shadow)).To(BeEmpty())
+		Expect(readFile(files.Group)).To(Equal("foo:!:1000:bar\nweb:$6$c$hash:1001:\n"))
+		Expect(readFile(files.GShadow)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,588 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Order used to write the identity files: groups are written before the
+// users that reference them and entities before their shadow entries.
+var transactionKinds = []string{GroupKind, GShadowKind, UserKind, ShadowKind}
+
+// Transaction applies entities to the identity databases in memory. Each
+// database is locked when first used and the lock is held until Commit or
+// Close. Commit writes every changed file once.
+//
+// When the state file of Files is defined, only the entities owned by
+// entities are deleted or pruned and the state is updated on Commit.
+type Transaction struct {
+	Files Files
+	// Record the entities created or applied in the state
+	Track bool
+	// Delete the entities not owned by entities too
+	Force bool
+	// Don't resolve the password sources, as a plan must not run commands
+	// or generate secrets
+	DryRun bool
+
+	dbs   map[string]*database
+	state *State
+	// Entities to update in the state on Commit, with their spec file
+	touched map[string]StateEntry
+	sources map[string]string
+}
+
+func NewTransaction(f Files) *Transaction {
+	return &Transaction{
+		Files:   f,
+		dbs:     make(map[string]*database),
+		touched: make(map[string]StateEntry),
+		sources: make(map[string]string),
+	}
+}
+
+// SetSource defines the spec file of the entity recorded in the state.
+func (t *Transaction) SetSource(e Entity, source string) {
+	t.sources[stateKey(e.GetKind(), EntityName(e))] = source
+}
+
+// State returns the state of the transaction, locking it when first used.
+// It returns nil if the state is disabled.
+func (t *Transaction) State() (*State, error) {
+	if t.state != nil || t.Files.State == "" {
+		return t.state, nil
+	}
+
+	st, err := OpenState(t.Files.State)
+	if err != nil {
+		return nil, err
+	}
+	t.state = st
+
+	return st, nil
+}
+
+// touch marks the entity to be updated in the state on Commit.
+func (t *Transaction) touch(kind, name string) {
+	key := stateKey(kind, name)
+	t.touched[key] = StateEntry{Kind: kind, Name: name, Source: t.sources[key]}
+}
+
+func (t *Transaction) db(kind string) (*database, error) {
+	if d, ok := t.dbs[kind]; ok {
+		return d, nil
+	}
+
+	path := t.Files.Path(kind)
+	if path == "" {
+		return nil, errors.New("Invalid entity kind " + kind)
+	}
+
+	// The gshadow file is created if missing, as GShadow.Create does
+	d, err := openDatabase(path, kind == GShadowKind, 0400)
+	if err != nil {
+		return nil, err
+	}
+	t.dbs[kind] = d
+
+	return d, nil
+}
+
+// usedIDs returns the uids or gids in use in the passwd or group database.
+func (t *Transaction) usedIDs(kind string) (map[int]struct{}, error) {
+	d, err := t.db(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[int]struct{})
+	for _, line := range d.lines {
+		fs := strings.Split(line, ":")
+		if len(fs) < 3 {
+			continue
+		}
+		if id, err := strconv.Atoi(fs[2]); err == nil {
+			used[id] = struct{}{}
+		}
+	}
+
+	return used, nil
+}
+
+func (t *Transaction) freeID(kind string) (int, error) {
+	used, err := t.usedIDs(kind)
+	if err != nil {
+		return -1, err
+	}
+	return freeID(used)
+}
+
+func (t *Transaction) groups() (map[string]Group, error) {
+	d, err := t.db(GroupKind)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGroupReader(bytes.NewReader(d.content()))
+}
+
+// prepare resolves the dynamic fields of the entity against the databases
+// of the transaction, so entities added before are taken into account.
+func (t *Transaction) prepare(e Entity) (Entity, error) {
+	switch v := e.(type) {
+	case UserPasswd:
+		if v.Username == "" {
+			return nil, errors.New("Empty username field")
+		}
+		return v.prepareWith(
+			func() (int, error) { return t.freeID(UserKind) },
+			t.groups,
+		)
+	case Group:
+		if v.Name == "" {
+			return nil, errors.New("Empty group name")
+		}
+		return v.prepareWith(func() (int, error) { return t.freeID(GroupKind) })
+	case Shadow:
+		if v.Username == "" {
+			return nil, errors.New("Empty username field")
+		}
+		return v.prepare()
+	case GShadow:
+		if v.Name == "" {
+			return nil, errors.New("Empty name field")
+		}
+		return v.prepare()
+	}
+
+	return nil, errors.New("Invalid entity")
+}
+
+// EntityName returns the name identifying the entity in its database.
+func EntityName(e Entity) string {
+	switch v := e.(type) {
+	case UserPasswd:
+		return v.Username
+	case Group:
+		return v.Name
+	case Shadow:
+		return v.Username
+	case GShadow:
+		return v.Name
+	}
+	return ""
+}
+
+// Create adds the entity, failing if already present.
+func (t *Transaction) Create(e Entity) error {
+	if t.DryRun {
+		e = unresolvedPassword(e, "", false)
+	}
+
+	e, err := t.prepare(e)
+	if err != nil {
+		return errors.Wrap(err, "Failed entity preparation")
+	}
+
+	d, err := t.db(e.GetKind())
+	if err != nil {
+		return err
+	}
+
+	name := EntityName(e)
+	if _, ok := d.get(name); ok {
+		return errors.New("Entity " + name + " already present")
+	}
+
+	switch v := e.(type) {
+	case UserPasswd:
+		e = v.withDefaults()
+	case Shadow:
+		e = v.merge(Shadow{})
+	}
+	d.set(name, e.String())
+	if t.Track {
+		t.touch(e.GetKind(), name)
+	}
+
+	return nil
+}
+
+// Fields of the lines of each identity file, named as in the specs
+var lineFields = map[string][]string{
+	UserKind:  {"username", "password", "uid", "gid", "info", "homedir", "shell"},
+	GroupKind: {"group_name", "password", "gid", "users"},
+	ShadowKind: {"username", "password", "last_changed", "minimum_changed",
+		"maximum_changed", "warn", "inactive", "expire", "reserved"},
+	GShadowKind: {"name", "password", "administrators", "members"},
+}
+
+// changedFields returns the names of the fields that differ between two
+// lines of a database of the given kind.
+func changedFields(kind, current, desired string) []string {
+	cfs := strings.Split(current, ":")
+	dfs := strings.Split(desired, ":")
+	names := lineFields[kind]
+
+	ans := []string{}
+	for i := 0; i < len(cfs) || i < len(dfs); i++ {
+		var c, d string
+		if i < len(cfs) {
+			c = cfs[i]
+		}
+		if i < len(dfs) {
+			d = dfs[i]
+		}
+		if c == d {
+			continue
+		}
+		if i < len(names) {
+			ans = append(ans, names[i])
+		} else {
+			ans = append(ans, strconv.Itoa(i))
+		}
+	}
+
+	return ans
+}
+
+// resolvePassword replaces the password source of the entity with the
+// password it defines, and returns it in cleartext to be compared with the
+// current one. The password of users is hashed here, as only the shadow
+// entities hash their password on prepare. Entities with both a password
+// and a source are left to prepare to reject.
+func resolvePassword(e Entity) (Entity, string, error) {
+	switch v := e.(type) {
+	case UserPasswd:
+		if v.PasswordSource.isSet() && v.Password == "" {
+			pwd, err := v.PasswordSource.resolve()
+			if err != nil {
+				return nil, "", err
+			}
+			v.Password, err = hashPassword(pwd)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "Failed hashing password")
+			}
+			v.PasswordSource = PasswordSource{}
+			return v, pwd, nil
+		}
+		return v, v.Password, nil
+	case Shadow:
+		if v.PasswordSource.isSet() && v.Password == "" {
+			pwd, err := v.PasswordSource.resolve()
+			if err != nil {
+				return nil, "", err
+			}
+			v.Password = pwd
+			v.PasswordSource = PasswordSource{}
+		}
+		return v, v.Password, nil
+	}
+	return e, entityPassword(e), nil
+}
+
+// plannedPassword replaces the passwords of the sources not resolved by a
+// dry run. It looks like a hash, to be shown redacted.
+const plannedPassword = "$" + RedactedPassword
+
+// unresolvedPassword replaces the password source of the entity with the
+// current password of its line, or with plannedPassword if the entity is
+// new, without running or generating anything.
+func unresolvedPassword(e Entity, line string, exists bool) Entity {
+	switch v := e.(type) {
+	case UserPasswd:
+		if !v.PasswordSource.isSet() || v.Password != "" {
+			return e
+		}
+		v.PasswordSource = PasswordSource{}
+		e = v
+	case Shadow:
+		if !v.PasswordSource.isSet() || v.Password != "" {
+			return e
+		}
+		v.PasswordSource = PasswordSource{}
+		e = v
+	default:
+		return e
+	}
+
+	if fs := strings.Split(line, ":"); exists && len(fs) > 1 {
+		return withPassword(e, fs[1])
+	}
+	return withPassword(e, plannedPassword)
+}
+
+// keepDynamicID sets the dynamic uid or gid (-1) of an entity already
+// present to the one it got when it was created.
+func keepDynamicID(e Entity, line string) Entity {
+	fs := strings.Split(line, ":")
+	if len(fs) < 3 {
+		return e
+	}
+	id, err := strconv.Atoi(fs[2])
+	if err != nil {
+		return e
+	}
+
+	switch v := e.(type) {
+	case UserPasswd:
+		if v.Uid < 0 {
+			v.Uid = id
+		}
+		return v
+	case Group:
+		if v.Gid != nil && *v.Gid < 0 {
+			v.Gid = &id
+		}
+		return v
+	}
+	return e
+}
+
+func entityPassword(e Entity) string {
+	switch v := e.(type) {
+	case UserPasswd:
+		return v.Password
+	case Group:
+		return v.Password
+	case Shadow:
+		return v.Password
+	case GShadow:
+		return v.Password
+	}
+	return ""
+}
+
+func withPassword(e Entity, p string) Entity {
+	switch v := e.(type) {
+	case UserPasswd:
+		v.Password = p
+		return v
+	case Group:
+		v.Password = p
+		return v
+	case Shadow:
+		v.Password = p
+		return v
+	case GShadow:
+		v.Password = p
+		return v
+	}
+	return e
+}
+
+// Apply adds or updates the entity with the semantics of Entity.Apply: in
+// safe mode existing entities and ids used by other entities are not
+// overridden. A plaintext password verifying against the current hash
+// keeps the hash, so that applying the same spec again changes nothing.
+func (t *Transaction) Apply(e Entity, safe bool) (ApplyResult, error) {
+	d, err := t.db(e.GetKind())
+	if err != nil {
+		return ApplyResult{}, err
+	}
+
+	name := EntityName(e)
+	line, exists := d.get(name)
+	res := ApplyResult{Kind: e.GetKind(), Name: name, Action: ActionUnchanged}
+
+	if exists {
+		e = keepDynamicID(e, line)
+	}
+	if t.DryRun {
+		e = unresolvedPassword(e, line, exists)
+	}
+
+	e, plain, err := resolvePassword(e)
+	if err != nil {
+		return ApplyResult{}, errors.Wrap(err, "Failed entity preparation")
+	}
+
+	e, err = t.prepare(e)
+	if err != nil {
+		return ApplyResult{}, errors.Wrap(err, "Failed entity preparation")
+	}
+
+	if exists && isPlainPassword(plain) {
+		if fs := strings.Split(line, ":"); len(fs) > 1 && PasswordMatch(fs[1], plain) {
+			e = withPassword(e, fs[1])
+		}
+	}
+
+	switch v := e.(type) {
+	case UserPasswd:
+		if !exists {
+			v = v.withDefaults()
+		} else if _, current, err := parseUserLine(line); err == nil && v.Info == "" {
+			// An empty info keeps the current one
+			v.Info = current.Info
+		}
+		e = v
+		if safe {
+			if owner, ok := d.idOwner(v.Uid); ok && owner != name {
+				return ApplyResult{}, errors.New(fmt.Sprintf("Uid %d is already used on user %s", v.Uid, owner))
+			}
+			if exists {
+				return res, nil
+			}
+		}
+	case Group:
+		if safe && v.Gid != nil {
+			if owner, ok := d.idOwner(*v.Gid); ok && owner != name {
+				return ApplyResult{}, errors.New(fmt.Sprintf("Gid %d is already used on group %s", *v.Gid, owner))
+			}
+		}
+		if exists {
+			_, g, err := parseGroupLine(line)
+			if err != nil {
+				return ApplyResult{}, errors.Wrap(err, "Failed parsing current group")
+			}
+			e = v.merge(g, safe)
+		}
+	case Shadow:
+		current := Shadow{}
+		if exists {
+			if safe {
+				return res, nil
+			}
+			_, current, err = parseLine(line)
+			if err != nil {
+				return ApplyResult{}, errors.Wrap(err, "Failed parsing current shadow")
+			}
+		}
+		e = v.merge(current)
+	case GShadow:
+		if exists && safe {
+			return res, nil
+		}
+	}
+
+	desired := e.String()
+	switch {
+	case !exists:
+		res.Action = ActionCreated
+	case line != desired:
+		res.Action = ActionUpdated
+		res.Changes = changedFields(res.Kind, line, desired)
+	}
+	d.set(name, desired)
+	if t.Track {
+		t.touch(res.Kind, name)
+	}
+
+	return res, nil
+}
+
+// ApplyEntity applies the entity to the file s, or to the default file of
+// its kind if s is empty, and returns the action taken. The file is not
+// written when the entity is unchanged. The entity is not recorded in the
+// state, use a Transaction with Track to own it.
+func ApplyEntity(e Entity, s string, safe bool) (ApplyResult, error) {
+	t := NewTransaction(EntityFiles(e, s))
+	defer t.Close()
+
+	res, err := t.Apply(e, safe)
+	if err != nil {
+		return res, err
+	}
+
+	return res, t.Commit()
+}
+
+type savepoint map[string]database
+
+// savepoint records the content of all the databases, to be restored
+// with rollback.
+func (t *Transaction) savepoint() (savepoint, error) {
+	sp := make(savepoint)
+	for _, kind := range transactionKinds {
+		d, err := t.db(kind)
+		if err != nil {
+			return nil, err
+		}
+		sp[kind] = database{
+			lines:   append([]string{}, d.lines...),
+			changed: d.changed,
+		}
+	}
+	return sp, nil
+}
+
+func (t *Transaction) rollback(sp savepoint) {
+	for kind, saved := range sp {
+		t.dbs[kind].lines = saved.lines
+		t.dbs[kind].changed = saved.changed
+	}
+}
+
+// Commit writes the changed databases and the state, and releases the
+// locks.
+func (t *Transaction) Commit() error {
+	defer t.Close()
+
+	for _, kind := range transactionKinds {
+		if d, ok := t.dbs[kind]; ok {
+			if err := d.commit(); err != nil {
+				return errors.Wrap(err, "Failed writing "+d.path)
+			}
+		}
+	}
+
+	return t.commitState()
+}
+
+// commitState records the touched entities still present in the databases
+// and forgets the removed ones.
+func (t *Transaction) commitState() error {
+	if len(t.touched) == 0 {
+		return nil
+	}
+
+	st, err := t.State()
+	if err != nil || st == nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	changed := false
+	for _, e := range t.touched {
+		line, ok := t.dbs[e.Kind].get(e.Name)
+		if ok {
+			changed = st.record(e.Kind, e.Name, e.Source, line, now) || changed
+		} else {
+			changed = st.Forget(e.Kind, e.Name) || changed
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return errors.Wrap(st.Save(), "Failed writing "+t.Files.State)
+}
+
+// Close releases the locks without writing the changes.
+func (t *Transaction) Close() {
+	for _, d := range t.dbs {
+		d.close()
+	}
+	if t.state != nil {
+		t.state.Close()
+	}
+}
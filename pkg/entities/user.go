@@ -40,6 +40,34 @@ func UserDefault(s string) string {
 	return s
 }
 
+// parseUserLine parses a passwd line, without the fallbacks of ParseUser
+// for invalid ids.
+func parseUserLine(line string) (string, UserPasswd, error) {
+	fs := strings.Split(line, ":")
+	if len(fs) != 7 {
+		return "", UserPasswd{}, errors.New("Unexpected number of fields in /etc/passwd: found " + strconv.Itoa(len(fs)))
+	}
+
+	uid, err := strconv.Atoi(fs[2])
+	if err != nil {
+		return "", UserPasswd{}, errors.New("Expected int for uid")
+	}
+	gid, err := strconv.Atoi(fs[3])
+	if err != nil {
+		return "", UserPasswd{}, errors.New("Expected int for gid")
+	}
+
+	return fs[0], UserPasswd{
+		Username: fs[0],
+		Password: fs[1],
+		Uid:      uid,
+		Gid:      gid,
+		Info:     fs[4],
+		Homedir:  fs[5],
+		Shell:    fs[6],
+	}, nil
+}
+
 func userGetFreeUid(path string) (int, error) {
 	list := xusers.NewUserList()
 	list.SetPath(path)
@@ -57,14 +85,16 @@ func userGetFreeUid(path string) (int, error) {
 }
 
 type UserPasswd struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Uid      int    `yaml:"uid"`
-	Gid      int    `yaml:"gid"`
-	Group    string `yaml:"group"`
-	Info     string `yaml:"info"`
-	Homedir  string `yaml:"homedir"`
-	Shell    string `yaml:"shell"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	Uid      int    `yaml:"uid" json:"uid"`
+	Gid      int    `yaml:"gid" json:"gid"`
+	Group    string `yaml:"group,omitempty" json:"group,omitempty"`
+	Info     string `yaml:"info" json:"info"`
+	Homedir  string `yaml:"homedir" json:"homedir"`
+	Shell    string `yaml:"shell" json:"shell"`
+
+	PasswordSource `yaml:",inline" json:"-"`
 }
 
 func ParseUser(path string) (map[string]UserPasswd, error) {
@@ -120,11 +150,29 @@ func ParseUser(path string) (map[string]UserPasswd, error) {
 func (u UserPasswd) GetKind() string { return UserKind }
 
 func (u UserPasswd) prepare(s string) (UserPasswd, error) {
+	return u.prepareWith(
+		func() (int, error) { return userGetFreeUid(s) },
+		func() (map[string]Group, error) { return ParseGroup(GroupsDefault("")) },
+	)
+}
+
+// withDefaults fills the fields left empty of a user being created. The
+// users already present keep their values.
+func (u UserPasswd) withDefaults() UserPasswd {
+	if u.Info == "" {
+		u.Info = "Created by entities"
+	}
+	return u
+}
+
+// prepareWith resolves the dynamic fields of the user getting the free uids
+// and the current groups from the given functions.
+func (u UserPasswd) prepareWith(freeUid func() (int, error), groups func() (map[string]Group, error)) (UserPasswd, error) {
 
 	if u.Uid < 0 {
 		// POST: dynamic user
 
-		uid, err := userGetFreeUid(s)
+		uid, err := freeUid()
 		if err != nil {
 			return u, err
 		}
@@ -133,14 +181,14 @@ func (u UserPasswd) prepare(s string) (UserPasswd, error) {
 
 	if u.Group != "" {
 		// POST: gid must be retrieved by existing file.
-		mGroups, err := ParseGroup(GroupsDefault(""))
+		mGroups, err := groups()
 		if err != nil {
 			return u, errors.Wrap(err, "Error on retrieve group information")
 		}
 
 		g, ok := mGroups[u.Group]
 		if !ok {
-			return u, errors.Wrap(err, fmt.Sprintf("The group %s is not present", u.Group))
+			return u, errors.New(fmt.Sprintf("The group %s is not present", u.Group))
 		}
 
 		u.Gid = *g.Gid
@@ -148,8 +196,21 @@ func (u UserPasswd) prepare(s string) (UserPasswd, error) {
 		u.Group = ""
 	}
 
-	if u.Info == "" {
-		u.Info = "Created by entities"
+	if u.PasswordSource.isSet() {
+		if u.Password != "" {
+			return u, errors.New("password can't be used together with a password source")
+		}
+		// Resolved passwords are never written in cleartext
+		pwd, err := u.PasswordSource.resolve()
+		if err == nil {
+			pwd, err = hashPassword(pwd)
+		}
+		if err != nil {
+			return u, errors.Wrap(err, fmt.Sprintf("Failed resolving password of %s", u.Username))
+		}
+		u.Password = pwd
+		// Avoid this operation if prepare is called multiple times.
+		u.PasswordSource = PasswordSource{}
 	}
 
 	return u, nil
@@ -241,6 +302,7 @@ func (u UserPasswd) Create(s string) error {
 	if err != nil {
 		return errors.Wrap(err, "Failed entity preparation")
 	}
+	u = u.withDefaults()
 
 	list := xusers.NewUserList()
 	list.SetPath(s)
@@ -271,94 +333,6 @@ func (u UserPasswd) Create(s string) error {
 }
 
 func (u UserPasswd) Apply(s string, safe bool) error {
-	if u.Username == "" {
-		return errors.New("Empty username field")
-	}
-
-	s = UserDefault(s)
-
-	u, err := u.prepare(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed entity preparation")
-	}
-
-	current, err := ParseUser(s)
-	if err != nil {
-		return err
-	}
-
-	permissions, err := permbits.Stat(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
-	}
-
-	if safe {
-		mUids := make(map[int]*UserPasswd)
-
-		// Create uids map to check uid mismatch
-		// Maybe could be done always
-		for _, e := range current {
-			mUids[e.Uid] = &e
-		}
-
-		if e, present := mUids[u.Uid]; present {
-			if e.Username != u.Username {
-				return errors.Wrap(err,
-					fmt.Sprintf("Uid %d is already used on user %s",
-						u.Uid, e.Username))
-			}
-		}
-	}
-
-	if _, ok := current[u.Username]; ok {
-		d, err := RetryForDuration()
-		if err != nil {
-			return errors.Wrap(err, "Failed getting delay")
-		}
-
-		baseName := filepath.Base(s)
-		if _, ok := os.Stat("/run/lock/"); os.IsNotExist(ok) {
-			_ = os.Mkdir("/run/lock/", 0755)
-		}
-		fileLock := flock.New(fmt.Sprintf("/run/lock/%s.lock", baseName))
-		defer os.Remove(fileLock.Path())
-		defer fileLock.Close()
-		lockCtx, cancel := context.WithTimeout(context.Background(), d)
-		defer cancel()
-
-		i, err := RetryIntervalDuration()
-		if err != nil {
-			return errors.Wrap(err, "Failed getting interval")
-		}
-		locked, err := fileLock.TryLockContext(lockCtx, i)
-		if err != nil || !locked {
-			return errors.Wrap(err, "Failed locking file")
-		}
-
-		input, err := os.ReadFile(s)
-		if err != nil {
-			return errors.Wrap(err, "Could not read input file")
-		}
-
-		lines := strings.Split(string(input), "\n")
-
-		for i, line := range lines {
-			if entityIdentifier(line) == u.Username {
-				if !safe {
-					lines[i] = u.String()
-				}
-			}
-		}
-		output := strings.Join(lines, "\n")
-		err = os.WriteFile(s, []byte(output), os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not write")
-		}
-
-	} else {
-		// Add it
-		return u.Create(s)
-	}
-
-	return nil
+	_, err := ApplyEntity(u, s, safe)
+	return err
 }
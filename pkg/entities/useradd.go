@@ -0,0 +1,729 @@
+/*
+Copyright © 2020 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultShell is the shell of the users added without one, as in
+// /etc/default/useradd.
+const DefaultShell = "/bin/sh"
+
+// UserAddOptions defines the user added by UserAdd, as the options of
+// useradd(8).
+type UserAddOptions struct {
+	// Uid of the user, allocated if nil
+	Uid *int
+	// Primary group, by name or gid. If empty a group named as the user is
+	// created.
+	Group string
+	// Supplementary groups, by name or gid
+	Groups []string
+	Info   string
+	// /home/<name> if empty
+	Homedir string
+	// DefaultShell if empty
+	Shell string
+	// Allocate the ids in the range of the system accounts
+	System bool
+}
+
+// UserModOptions defines the changes made by UserMod, as the options of
+// usermod(8). Empty fields are kept.
+type UserModOptions struct {
+	Uid *int
+	// Primary group, by name or gid
+	Group string
+	// Supplementary groups, by name or gid. They replace the current ones
+	// unless Append is set, nil keeps them.
+	Groups  []string
+	Append  bool
+	Info    string
+	Homedir string
+	Shell   string
+}
+
+// GroupAddOptions defines the group added by GroupAdd, as the options of
+// groupadd(8).
+type GroupAddOptions struct {
+	// Gid of the group, allocated if nil
+	Gid *int
+	// Allocate the gid in the range of the system accounts
+	System bool
+}
+
+// AccountChanges are the entities written and removed by the account
+// functions, as they are in the identity files after the change.
+type AccountChanges struct {
+	Applied []Entity
+	Deleted []Entity
+}
+
+// Specs returns the applied entities as specs. The password hashes are
+// replaced as in Export, so that the specs keep the current passwords.
+func (c AccountChanges) Specs() []Entity {
+	ans := []Entity{}
+	for _, e := range c.Applied {
+		ans = append(ans, withoutPassword(e))
+	}
+	return ans
+}
+
+// UserAdd adds the user with its shadow entry, locked, as useradd(8) does.
+func UserAdd(f Files, name string, opts UserAddOptions) (AccountChanges, error) {
+	return commitAccount(f, func(t *Transaction) (AccountChanges, error) {
+		return t.UserAdd(name, opts)
+	})
+}
+
+// UserMod changes the user as usermod(8) does.
+func UserMod(f Files, name string, opts UserModOptions) (AccountChanges, error) {
+	return commitAccount(f, func(t *Transaction) (AccountChanges, error) {
+		return t.UserMod(name, opts)
+	})
+}
+
+// UserDel removes the user as userdel(8) does. Only the users owned by
+// entities are removed: use a Transaction with Force for the others.
+func UserDel(f Files, name string) (AccountChanges, error) {
+	return commitAccount(f, func(t *Transaction) (AccountChanges, error) {
+		return t.UserDel(name)
+	})
+}
+
+// GroupAdd adds the group with its gshadow entry as groupadd(8) does.
+func GroupAdd(f Files, name string, opts GroupAddOptions) (AccountChanges, error) {
+	return commitAccount(f, func(t *Transaction) (AccountChanges, error) {
+		return t.GroupAdd(name, opts)
+	})
+}
+
+// GroupDel removes the group as groupdel(8) does. Only the groups owned by
+// entities are removed: use a Transaction with Force for the others.
+func GroupDel(f Files, name string) (AccountChanges, error) {
+	return commitAccount(f, func(t *Transaction) (AccountChanges, error) {
+		return t.GroupDel(name)
+	})
+}
+
+func commitAccount(f Files, fn func(t *Transaction) (AccountChanges, error)) (AccountChanges, error) {
+	t := NewTransaction(f)
+	t.Track = true
+	defer t.Close()
+
+	c, err := fn(t)
+	if err != nil {
+		return c, err
+	}
+
+	return c, t.Commit()
+}
+
+// UserAdd is the UserAdd function on the databases of the transaction.
+func (t *Transaction) UserAdd(name string, opts UserAddOptions) (AccountChanges, error) {
+	c := &accountChanges{}
+
+	if err := validAccountName(name); err != nil {
+		return AccountChanges{}, err
+	}
+	users, err := t.db(UserKind)
+	if err != nil {
+		return AccountChanges{}, err
+	}
+	if _, ok := users.get(name); ok {
+		return AccountChanges{}, errors.New("User " + name + " already present")
+	}
+
+	uid := -1
+	if opts.Uid != nil {
+		if err := t.checkID(UserKind, *opts.Uid); err != nil {
+			return AccountChanges{}, err
+		}
+		uid = *opts.Uid
+	} else if uid, err = t.allocID(UserKind, opts.System, -1); err != nil {
+		return AccountChanges{}, err
+	}
+
+	var gid int
+	if opts.Group == "" {
+		// A group named as the user, with the same id if free
+		groups, err := t.db(GroupKind)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		if _, ok := groups.get(name); ok {
+			return AccountChanges{}, errors.New(
+				"Group " + name + " already present: use the group option to add the user to it")
+		}
+		if gid, err = t.allocID(GroupKind, opts.System, uid); err != nil {
+			return AccountChanges{}, err
+		}
+		if err := t.addGroup(name, gid, c); err != nil {
+			return AccountChanges{}, err
+		}
+	} else {
+		g, err := t.findGroup(opts.Group)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		gid = *g.Gid
+	}
+
+	user := UserPasswd{
+		Username: name,
+		Password: "x",
+		Uid:      uid,
+		Gid:      gid,
+		Info:     opts.Info,
+		Homedir:  opts.Homedir,
+		Shell:    opts.Shell,
+	}
+	if user.Homedir == "" {
+		user.Homedir = "/home/" + name
+	}
+	if user.Shell == "" {
+		user.Shell = DefaultShell
+	}
+	if err := t.Create(user); err != nil {
+		return AccountChanges{}, err
+	}
+	c.apply(UserKind, name)
+
+	if err := t.Create(Shadow{Username: name, Password: "!", LastChanged: "now"}); err != nil {
+		return AccountChanges{}, err
+	}
+	c.apply(ShadowKind, name)
+
+	for _, key := range opts.Groups {
+		g, err := t.findGroup(key)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		if err := t.setMember(g.Name, name, true, c); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+
+	return t.accountChanges(c)
+}
+
+// UserMod is the UserMod function on the databases of the transaction.
+func (t *Transaction) UserMod(name string, opts UserModOptions) (AccountChanges, error) {
+	c := &accountChanges{}
+
+	u, ok, err := t.user(name)
+	if err != nil {
+		return AccountChanges{}, err
+	}
+	if !ok {
+		return AccountChanges{}, errors.New("User " + name + " is not present")
+	}
+
+	current := u.String()
+	if opts.Uid != nil && *opts.Uid != u.Uid {
+		if err := t.checkID(UserKind, *opts.Uid); err != nil {
+			return AccountChanges{}, err
+		}
+		u.Uid = *opts.Uid
+	}
+	if opts.Group != "" {
+		g, err := t.findGroup(opts.Group)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		u.Gid = *g.Gid
+	}
+	if opts.Info != "" {
+		u.Info = opts.Info
+	}
+	if opts.Homedir != "" {
+		u.Homedir = opts.Homedir
+	}
+	if opts.Shell != "" {
+		u.Shell = opts.Shell
+	}
+	if u.String() != current {
+		if err := t.setEntity(u, c); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+
+	if opts.Groups == nil {
+		return t.accountChanges(c)
+	}
+
+	wanted := map[string]bool{}
+	for _, key := range opts.Groups {
+		g, err := t.findGroup(key)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		wanted[g.Name] = true
+		if err := t.setMember(g.Name, name, true, c); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+	if !opts.Append {
+		groups, err := t.memberOf(name)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		for _, g := range groups {
+			if wanted[g] {
+				continue
+			}
+			if err := t.setMember(g, name, false, c); err != nil {
+				return AccountChanges{}, err
+			}
+		}
+	}
+
+	return t.accountChanges(c)
+}
+
+// UserDel is the UserDel function on the databases of the transaction. The
+// user is removed from the members of the groups and its primary group is
+// removed too if named as the user and not the primary group of others.
+func (t *Transaction) UserDel(name string) (AccountChanges, error) {
+	c := &accountChanges{}
+
+	u, ok, err := t.user(name)
+	if err != nil {
+		return AccountChanges{}, err
+	}
+	if !ok {
+		return AccountChanges{}, errors.New("User " + name + " is not present")
+	}
+
+	for _, kind := range []string{ShadowKind, UserKind} {
+		if err := t.deleteEntity(kind, name, c); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+
+	groups, err := t.memberOf(name)
+	if err != nil {
+		return AccountChanges{}, err
+	}
+	for _, g := range groups {
+		if err := t.setMember(g, name, false, c); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+
+	g, ok, err := t.group(name)
+	if err != nil {
+		return AccountChanges{}, err
+	}
+	if ok && g.Gid != nil && *g.Gid == u.Gid {
+		if primary, err := t.primaryOf(u.Gid); err != nil {
+			return AccountChanges{}, err
+		} else if len(primary) == 0 {
+			for _, kind := range []string{GShadowKind, GroupKind} {
+				if err := t.deleteEntity(kind, name, c); err != nil {
+					return AccountChanges{}, err
+				}
+			}
+		}
+	}
+
+	return t.accountChanges(c)
+}
+
+// GroupAdd is the GroupAdd function on the databases of the transaction.
+func (t *Transaction) GroupAdd(name string, opts GroupAddOptions) (AccountChanges, error) {
+	c := &accountChanges{}
+
+	if err := validAccountName(name); err != nil {
+		return AccountChanges{}, err
+	}
+	if _, ok, err := t.group(name); err != nil {
+		return AccountChanges{}, err
+	} else if ok {
+		return AccountChanges{}, errors.New("Group " + name + " already present")
+	}
+
+	gid := -1
+	if opts.Gid != nil {
+		if err := t.checkID(GroupKind, *opts.Gid); err != nil {
+			return AccountChanges{}, err
+		}
+		gid = *opts.Gid
+	} else {
+		var err error
+		if gid, err = t.allocID(GroupKind, opts.System, -1); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+
+	if err := t.addGroup(name, gid, c); err != nil {
+		return AccountChanges{}, err
+	}
+
+	return t.accountChanges(c)
+}
+
+// GroupDel is the GroupDel function on the databases of the transaction.
+// The primary group of a user can't be removed.
+func (t *Transaction) GroupDel(name string) (AccountChanges, error) {
+	c := &accountChanges{}
+
+	g, ok, err := t.group(name)
+	if err != nil {
+		return AccountChanges{}, err
+	}
+	if !ok {
+		return AccountChanges{}, errors.New("Group " + name + " is not present")
+	}
+
+	if g.Gid != nil {
+		primary, err := t.primaryOf(*g.Gid)
+		if err != nil {
+			return AccountChanges{}, err
+		}
+		if len(primary) > 0 {
+			return AccountChanges{}, errors.New(fmt.Sprintf(
+				"Group %s is the primary group of %s", name, strings.Join(primary, ",")))
+		}
+	}
+
+	for _, kind := range []string{GShadowKind, GroupKind} {
+		if err := t.deleteEntity(kind, name, c); err != nil {
+			return AccountChanges{}, err
+		}
+	}
+
+	return t.accountChanges(c)
+}
+
+// validAccountName rejects the names that would break the identity files
+// or be taken as options.
+func validAccountName(name string) error {
+	if name == "" || strings.HasPrefix(name, "-") || strings.ContainsAny(name, ":,\n\t ") {
+		return errors.New(fmt.Sprintf("Invalid name %q", name))
+	}
+	return nil
+}
+
+type accountKey struct {
+	kind string
+	name string
+}
+
+// accountChanges records the entities changed by the account functions.
+type accountChanges struct {
+	applied []accountKey
+	deleted []Entity
+}
+
+func (c *accountChanges) apply(kind, name string) {
+	for _, k := range c.applied {
+		if k.kind == kind && k.name == name {
+			return
+		}
+	}
+	c.applied = append(c.applied, accountKey{kind, name})
+}
+
+// accountChanges returns the changed entities as they are in the databases,
+// in the order of transactionKinds. The users have the name of their
+// primary group, so that their specs don't depend on the gid.
+func (t *Transaction) accountChanges(c *accountChanges) (AccountChanges, error) {
+	ans := AccountChanges{Applied: []Entity{}, Deleted: c.deleted}
+	for _, kind := range transactionKinds {
+		for _, k := range c.applied {
+			if k.kind != kind {
+				continue
+			}
+			e, ok, err := t.entity(kind, k.name)
+			if err != nil {
+				return AccountChanges{}, err
+			}
+			if !ok {
+				continue
+			}
+			if u, isUser := e.(UserPasswd); isUser {
+				groups, err := t.db(GroupKind)
+				if err != nil {
+					return AccountChanges{}, err
+				}
+				if g, found := groups.idOwner(u.Gid); found {
+					u.Group = g
+				}
+				e = u
+			}
+			ans.Applied = append(ans.Applied, e)
+		}
+	}
+	return ans, nil
+}
+
+// entity returns the entity of the kind with the name from its database.
+func (t *Transaction) entity(kind, name string) (Entity, bool, error) {
+	d, err := t.db(kind)
+	if err != nil {
+		return nil, false, err
+	}
+	line, ok := d.get(name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	var e Entity
+	switch kind {
+	case UserKind:
+		_, e, err = parseUserLine(line)
+	case GroupKind:
+		_, e, err = parseGroupLine(line)
+	case ShadowKind:
+		_, e, err = parseLine(line)
+	case GShadowKind:
+		_, e, err = parseGShadowLine(line)
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Failed parsing the "+kind+" "+name)
+	}
+
+	return e, true, nil
+}
+
+func (t *Transaction) user(name string) (UserPasswd, bool, error) {
+	e, ok, err := t.entity(UserKind, name)
+	if !ok || err != nil {
+		return UserPasswd{}, ok, err
+	}
+	return e.(UserPasswd), true, nil
+}
+
+func (t *Transaction) group(name string) (Group, bool, error) {
+	e, ok, err := t.entity(GroupKind, name)
+	if !ok || err != nil {
+		return Group{}, ok, err
+	}
+	return e.(Group), true, nil
+}
+
+// findGroup returns the group with the name or, if there is none, with the
+// numeric gid.
+func (t *Transaction) findGroup(key string) (Group, error) {
+	g, ok, err := t.group(key)
+	if err != nil || ok {
+		return g, err
+	}
+
+	if id, err := strconv.Atoi(key); err == nil {
+		groups, err := t.db(GroupKind)
+		if err != nil {
+			return Group{}, err
+		}
+		if name, found := groups.idOwner(id); found {
+			g, _, err := t.group(name)
+			return g, err
+		}
+	}
+
+	return Group{}, errors.New(fmt.Sprintf("The group %s is not present", key))
+}
+
+// checkID fails if the uid or gid is negative or already used.
+func (t *Transaction) checkID(kind string, id int) error {
+	if id < 0 {
+		return errors.New(fmt.Sprintf("Invalid id %d", id))
+	}
+	d, err := t.db(kind)
+	if err != nil {
+		return err
+	}
+	if owner, ok := d.idOwner(id); ok {
+		return errors.New(fmt.Sprintf("Id %d is already used on %s %s", id, kind, owner))
+	}
+	return nil
+}
+
+// allocID returns the preferred id if free, otherwise the lowest free id of
+// the human range or the highest free id of the system range, as useradd
+// does.
+func (t *Transaction) allocID(kind string, system bool, preferred int) (int, error) {
+	used, err := t.usedIDs(kind)
+	if err != nil {
+		return -1, err
+	}
+	if _, found := used[preferred]; preferred >= 0 && !found {
+		return preferred, nil
+	}
+	if !system {
+		return freeID(used)
+	}
+	for i := SystemIDMax; i >= SystemIDMin; i-- {
+		if _, found := used[i]; !found {
+			return i, nil
+		}
+	}
+	return -1, errors.New("no available id in the system range")
+}
+
+// addGroup creates the group with a locked gshadow entry.
+func (t *Transaction) addGroup(name string, gid int, c *accountChanges) error {
+	if err := t.Create(Group{Name: name, Password: "x", Gid: &gid}); err != nil {
+		return err
+	}
+	c.apply(GroupKind, name)
+
+	gshadows, err := t.db(GShadowKind)
+	if err != nil {
+		return err
+	}
+	if _, ok := gshadows.get(name); !ok {
+		if err := t.Create(GShadow{Name: name, Password: "!"}); err != nil {
+			return err
+		}
+		c.apply(GShadowKind, name)
+	}
+	return nil
+}
+
+// setEntity replaces the line of the entity. The state is updated only if
+// the entity is already owned, editing an entity doesn't take it over.
+func (t *Transaction) setEntity(e Entity, c *accountChanges) error {
+	d, err := t.db(e.GetKind())
+	if err != nil {
+		return err
+	}
+	name := EntityName(e)
+	d.set(name, e.String())
+	if t.Track {
+		st, err := t.State()
+		if err != nil {
+			return err
+		}
+		if st != nil && st.Owns(e.GetKind(), name) {
+			t.touch(e.GetKind(), name)
+		}
+	}
+	c.apply(e.GetKind(), name)
+	return nil
+}
+
+func deleteFromList(list, name string) string {
+	ans := []string{}
+	for _, m := range strings.Split(list, ",") {
+		if m != "" && m != name {
+			ans = append(ans, m)
+		}
+	}
+	return strings.Join(ans, ",")
+}
+
+func addToList(list, name string) string {
+	if listHas(list, name) {
+		return list
+	}
+	if list == "" {
+		return name
+	}
+	return list + "," + name
+}
+
+// setMember adds the user to the members of the group and of its gshadow
+// entry, if any, or removes it from them and from the administrators.
+func (t *Transaction) setMember(group, user string, member bool, c *accountChanges) error {
+	if g, ok, err := t.group(group); err != nil {
+		return err
+	} else if ok {
+		users := deleteFromList(g.Users, user)
+		if member {
+			users = addToList(g.Users, user)
+		}
+		if users != g.Users {
+			g.Users = users
+			if err := t.setEntity(g, c); err != nil {
+				return err
+			}
+		}
+	}
+
+	e, ok, err := t.entity(GShadowKind, group)
+	if err != nil || !ok {
+		return err
+	}
+	gs := e.(GShadow)
+	current := gs.String()
+	if member {
+		gs.Members = addToList(gs.Members, user)
+	} else {
+		gs.Members = deleteFromList(gs.Members, user)
+		gs.Administrators = deleteFromList(gs.Administrators, user)
+	}
+	if gs.String() != current {
+		return t.setEntity(gs, c)
+	}
+	return nil
+}
+
+// memberOf returns the groups listing the user in the group or gshadow
+// entry, as members or administrators.
+func (t *Transaction) memberOf(user string) ([]string, error) {
+	ans := []string{}
+	seen := map[string]bool{}
+	for _, kind := range []string{GroupKind, GShadowKind} {
+		d, err := t.db(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range d.lines {
+			fs := strings.Split(line, ":")
+			if len(fs) != 4 || seen[fs[0]] {
+				continue
+			}
+			if listHas(fs[3], user) || (kind == GShadowKind && listHas(fs[2], user)) {
+				seen[fs[0]] = true
+				ans = append(ans, fs[0])
+			}
+		}
+	}
+	return ans, nil
+}
+
+// primaryOf returns the users with the gid as primary group.
+func (t *Transaction) primaryOf(gid int) ([]string, error) {
+	users, err := t.db(UserKind)
+	if err != nil {
+		return nil, err
+	}
+	ans := []string{}
+	for _, line := range users.lines {
+		if name, u, err := parseUserLine(line); err == nil && u.Gid == gid {
+			ans = append(ans, name)
+		}
+	}
+	return ans, nil
+}
+
+// deleteEntity removes the entity of the kind with the name, if present.
+func (t *Transaction) deleteEntity(kind, name string, c *accountChanges) error {
+	e, ok, err := t.entity(kind, name)
+	if err != nil || !ok {
+		return err
+	}
+	if err := t.Delete(e); err != nil {
+		return err
+	}
+	c.deleted = append(c.deleted, e)
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+                 Daniele Rondina <geaaru@sabayon.org>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Account commands", func() {
+	var root string
+	var files Files
+
+	BeforeEach(func() {
+		root, files = newTestRoot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	names := func(entities []Entity) []string {
+		ans := []string{}
+		for _, e := range entities {
+			ans = append(ans, e.GetKind()+"/"+EntityName(e))
+		}
+		return ans
+	}
+
+	It("adds users with their group", func() {
+		_, err := GroupAdd(files, "devs", GroupAddOptions{})
+		Expect(err).Should(BeNil())
+
+		c, err := UserAdd(files, "foo", UserAddOptions{Groups: []string{"devs"}, Shell: "/bin/bash"})
+		Expect(err).Should(BeNil())
+		Expect(names(c.Applied)).To(Equal([]string{
+			"group/foo", "group/devs", "gshadow/foo", "gshadow/devs", "user/foo", "shadow/foo",
+		}))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users["foo"].Uid).To(Equal(1000))
+		Expect(users["foo"].Homedir).To(Equal("/home/foo"))
+		Expect(users["foo"].Shell).To(Equal("/bin/bash"))
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(*groups["devs"].Gid).To(Equal(1000))
+		Expect(*groups["foo"].Gid).To(Equal(1001))
+		Expect(users["foo"].Gid).To(Equal(1001))
+		Expect(groups["devs"].Users).To(Equal("foo"))
+
+		shadows, err := ParseShadow(files.Shadow)
+		Expect(err).Should(BeNil())
+		Expect(shadows["foo"].Password).To(Equal("!"))
+
+		specs := c.Specs()
+		Expect(specs[4]).To(HaveField("Group", "foo"))
+
+		_, err = UserAdd(files, "foo", UserAddOptions{})
+		Expect(err).ShouldNot(BeNil())
+		uid := 1000
+		_, err = UserAdd(files, "bar", UserAddOptions{Uid: &uid})
+		Expect(err).ShouldNot(BeNil())
+		_, err = UserAdd(files, "bar", UserAddOptions{Group: "nope"})
+		Expect(err).ShouldNot(BeNil())
+		_, err = UserAdd(files, "b:r", UserAddOptions{})
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("allocates the system ids from the top of the range", func() {
+		// No group has gid 1000
+		_, err := UserAdd(files, "svc", UserAddOptions{System: true, Group: "1000"})
+		Expect(err).ShouldNot(BeNil())
+
+		c, err := UserAdd(files, "svc", UserAddOptions{System: true})
+		Expect(err).Should(BeNil())
+		u := c.Applied[2].(UserPasswd)
+		Expect(u.Uid).To(BeNumerically("<=", SystemIDMax))
+		Expect(u.Uid).To(BeNumerically(">=", SystemIDMin))
+		Expect(u.Gid).To(Equal(u.Uid))
+	})
+
+	It("modifies the users", func() {
+		for _, g := range []string{"a", "b", "c"} {
+			_, err := GroupAdd(files, g, GroupAddOptions{})
+			Expect(err).Should(BeNil())
+		}
+		_, err := UserAdd(files, "foo", UserAddOptions{Groups: []string{"a", "b"}})
+		Expect(err).Should(BeNil())
+
+		c, err := UserMod(files, "foo", UserModOptions{Shell: "/bin/zsh", Groups: []string{"c"}, Append: true})
+		Expect(err).Should(BeNil())
+		Expect(names(c.Applied)).To(Equal([]string{"group/c", "gshadow/c", "user/foo"}))
+
+		c, err = UserMod(files, "foo", UserModOptions{Groups: []string{"b"}})
+		Expect(err).Should(BeNil())
+		Expect(names(c.Applied)).To(Equal([]string{"group/a", "group/c", "gshadow/a", "gshadow/c"}))
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(groups["a"].Users).To(Equal(""))
+		Expect(groups["b"].Users).To(Equal("foo"))
+		Expect(groups["c"].Users).To(Equal(""))
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users["foo"].Shell).To(Equal("/bin/zsh"))
+
+		_, err = UserMod(files, "nope", UserModOptions{})
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("deletes the users and their private group", func() {
+		_, err := GroupAdd(files, "devs", GroupAddOptions{})
+		Expect(err).Should(BeNil())
+		_, err = UserAdd(files, "foo", UserAddOptions{Groups: []string{"devs"}})
+		Expect(err).Should(BeNil())
+
+		_, err = GroupDel(files, "foo")
+		Expect(err).ShouldNot(BeNil())
+
+		c, err := UserDel(files, "foo")
+		Expect(err).Should(BeNil())
+		Expect(names(c.Deleted)).To(Equal([]string{"shadow/foo", "user/foo", "gshadow/foo", "group/foo"}))
+		Expect(names(c.Applied)).To(Equal([]string{"group/devs", "gshadow/devs"}))
+
+		gshadows, err := ParseGShadow(files.GShadow)
+		Expect(err).Should(BeNil())
+		Expect(gshadows).ToNot(HaveKey("foo"))
+		Expect(gshadows["devs"].Members).To(Equal(""))
+
+		c, err = GroupDel(files, "devs")
+		Expect(err).Should(BeNil())
+		Expect(names(c.Deleted)).To(Equal([]string{"gshadow/devs", "group/devs"}))
+	})
+
+	It("deletes only the users owned by entities", func() {
+		_, err := UserDel(files, "lp")
+		Expect(err).ShouldNot(BeNil())
+
+		t := NewTransaction(files)
+		t.Force = true
+		defer t.Close()
+		_, err = t.UserDel("lp")
+		Expect(err).Should(BeNil())
+		Expect(t.Commit()).Should(BeNil())
+
+		users, err := ParseUser(files.Passwd)
+		Expect(err).Should(BeNil())
+		Expect(users).ToNot(HaveKey("lp"))
+	})
+
+	It("doesn't take over the groups the users are added to", func() {
+		_, err := UserAdd(files, "foo", UserAddOptions{Groups: []string{"ntp"}})
+		Expect(err).Should(BeNil())
+
+		st, err := ReadState(files.State)
+		Expect(err).Should(BeNil())
+		Expect(st.Owns(UserKind, "foo")).To(BeTrue())
+		Expect(st.Owns(GroupKind, "ntp")).To(BeFalse())
+		Expect(st.Owns(GShadowKind, "ntp")).To(BeFalse())
+
+		_, err = GroupDel(files, "ntp")
+		Expect(err).ShouldNot(BeNil())
+
+		groups, err := ParseGroup(files.Group)
+		Expect(err).Should(BeNil())
+		Expect(groups).To(HaveKey("ntp"))
+	})
+
+	It("manages the home directories", func() {
+		skel := filepath.Join(root, "etc", "skel")
+		Expect(os.MkdirAll(skel, 0755)).Should(BeNil())
+		Expect(os.WriteFile(filepath.Join(skel, ".profile"), []byte("x"), 0644)).Should(BeNil())
+
+		Expect(CreateHome(root, "/home/foo", os.Getuid(), os.Getgid())).Should(BeNil())
+		Expect(filepath.Join(root, "home", "foo", ".profile")).To(BeARegularFile())
+
+		// An existing home is kept as is
+		Expect(os.Remove(filepath.Join(root, "home", "foo", ".profile"))).Should(BeNil())
+		Expect(CreateHome(root, "/home/foo", os.Getuid(), os.Getgid())).ShouldNot(BeNil())
+		Expect(filepath.Join(root, "home", "foo", ".profile")).ToNot(BeAnExistingFile())
+		Expect(os.WriteFile(filepath.Join(root, "home", "foo", ".profile"), []byte("x"), 0644)).Should(BeNil())
+
+		Expect(MoveHome(root, "/home/foo", "/srv/foo")).Should(BeNil())
+		Expect(filepath.Join(root, "srv", "foo", ".profile")).To(BeARegularFile())
+		Expect(filepath.Join(root, "home", "foo")).ToNot(BeADirectory())
+
+		foo := UserPasswd{Username: "foo", Uid: os.Getuid(), Homedir: "/srv/foo"}
+		users := map[string]UserPasswd{"bar": {Username: "bar", Uid: 1001, Homedir: "/srv/foo/"}}
+		Expect(RemoveHome(root, foo, users)).ShouldNot(BeNil())
+		Expect(filepath.Join(root, "srv", "foo")).To(BeADirectory())
+
+		Expect(RemoveHome(root, UserPasswd{Username: "bar", Uid: os.Getuid() + 1, Homedir: "/srv/foo"}, nil)).ShouldNot(BeNil())
+		Expect(filepath.Join(root, "srv", "foo")).To(BeADirectory())
+
+		Expect(RemoveHome(root, foo, nil)).Should(BeNil())
+		Expect(filepath.Join(root, "srv", "foo")).ToNot(BeADirectory())
+
+		Expect(RemoveHome(root, UserPasswd{Username: "foo", Homedir: "/"}, nil)).ShouldNot(BeNil())
+		Expect(RemoveHome(root, UserPasswd{Username: "foo", Homedir: "home"}, nil)).ShouldNot(BeNil())
+	})
+})